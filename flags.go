@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"time"
+)
+
+// flagDefs records filewatch's flags as they're defined, so that every Run
+// parses its arguments with a FlagSet of its own and every value starts out
+// at its default again. The methods mirror flag.FlagSet's.
+type flagDefs struct {
+	defs []func(fs *flag.FlagSet)
+}
+
+// flags are filewatch's command line flags, see flagDefs.
+var flags = &flagDefs{}
+
+// resetter is a flag.Value that can go back to its zero value, like the
+// flags that may be repeated.
+type resetter interface {
+	reset()
+}
+
+func (d *flagDefs) Bool(name string, value bool, usage string) *bool {
+	p := new(bool)
+	d.defs = append(d.defs, func(fs *flag.FlagSet) { fs.BoolVar(p, name, value, usage) })
+	*p = value
+	return p
+}
+
+func (d *flagDefs) Int(name string, value int, usage string) *int {
+	p := new(int)
+	d.defs = append(d.defs, func(fs *flag.FlagSet) { fs.IntVar(p, name, value, usage) })
+	*p = value
+	return p
+}
+
+func (d *flagDefs) String(name string, value string, usage string) *string {
+	p := new(string)
+	d.defs = append(d.defs, func(fs *flag.FlagSet) { fs.StringVar(p, name, value, usage) })
+	*p = value
+	return p
+}
+
+func (d *flagDefs) Duration(name string, value time.Duration, usage string) *time.Duration {
+	p := new(time.Duration)
+	d.defs = append(d.defs, func(fs *flag.FlagSet) { fs.DurationVar(p, name, value, usage) })
+	*p = value
+	return p
+}
+
+// Var defines a flag of a type of its own, reset first if it's a resetter.
+func (d *flagDefs) Var(value flag.Value, name string, usage string) {
+	d.defs = append(d.defs, func(fs *flag.FlagSet) {
+		if r, ok := value.(resetter); ok {
+			r.reset()
+		}
+		fs.Var(value, name, usage)
+	})
+}
+
+// newFlagSet defines all flags on a new FlagSet writing its errors and
+// usage to output, with their values back at the defaults.
+func (d *flagDefs) newFlagSet(output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("filewatch", flag.ContinueOnError)
+	fs.SetOutput(output)
+	for _, def := range d.defs {
+		def(fs)
+	}
+	return fs
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// globber is a glob engine, picked with -matcher. Both the files found at
+// startup and the events coming in go through the same one.
+type globber interface {
+	Match(pattern string, name string) (bool, error)
+	Glob(pattern string) ([]string, error)
+}
+
+// matchers are the values -matcher accepts.
+var matchers = map[string]globber{
+	"zglob":      zglobber{},
+	"doublestar": doublestarGlobber{},
+}
+
+// matcher is the globber in use, set once in main.
+var matcher globber = zglobber{}
+
+func globMatch(pattern string, name string) (bool, error) {
+	return matcher.Match(pattern, name)
+}
+
+func globExpand(pattern string) ([]string, error) {
+	return matcher.Glob(pattern)
+}
+
+type zglobber struct{}
+
+func (zglobber) Match(pattern string, name string) (bool, error) {
+	pattern = globClasses(pattern)
+	if !isZglob(pattern) {
+		return filepath.Match(pattern, name)
+	}
+	return zglob.Match(pattern, name)
+}
+
+func (zglobber) Glob(pattern string) ([]string, error) {
+	pattern = globClasses(pattern)
+	if !isZglob(pattern) {
+		return filepath.Glob(pattern)
+	}
+	return zglob.Glob(pattern)
+}
+
+// globClasses rewrites the shell's [!...] negation to the [^...] form zglob,
+// doublestar and filepath all understand. Left alone, zglob takes the ! for a
+// character of the class.
+func globClasses(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		b.WriteByte(pattern[i])
+		if pattern[i] == '\\' && filepath.Separator != '\\' && i+1 < len(pattern) {
+			i++
+			b.WriteByte(pattern[i])
+		} else if pattern[i] == '[' && i+1 < len(pattern) && pattern[i+1] == '!' {
+			b.WriteByte('^')
+			i++
+		}
+	}
+	return b.String()
+}
+
+// isZglob reports whether zglob treats pattern as a pattern. Without a * or
+// a { it's taken for a plain path, classes and ? notwithstanding, so those
+// go to filepath instead.
+func isZglob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*{")
+}
+
+// doublestarGlobber follows bmatcuk/doublestar. Its 1.x releases are the
+// ones that build without modules, like the rest of filewatch. They take the
+// ! of [!...] for a character of the class too, so it's rewritten the same.
+type doublestarGlobber struct{}
+
+func (doublestarGlobber) Match(pattern string, name string) (bool, error) {
+	return doublestar.PathMatch(globClasses(pattern), name)
+}
+
+func (doublestarGlobber) Glob(pattern string) ([]string, error) {
+	return doublestar.Glob(globClasses(pattern))
+}
+
+// checkPattern reports what's wrong with a -filenames or exclude pattern,
+// nil if nothing is. Both glob engines take a malformed pattern for one that
+// simply never matches, which is hard to tell from a pattern that just
+// doesn't match yet.
+func checkPattern(pattern string, include bool) error {
+	if *literal {
+		return nil
+	}
+	if *useRegex && include {
+		_, err := regexp.Compile(pattern)
+		return err
+	}
+	braces := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if filepath.Separator != '\\' {
+				i++
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return fmt.Errorf("[ without ]")
+			}
+			if class := strings.TrimLeft(pattern[i+1:i+1+end], "!^"); class == "" {
+				return fmt.Errorf("empty character class")
+			}
+			i += end + 1
+		case '{':
+			braces++
+		case '}':
+			if braces == 0 {
+				return fmt.Errorf("} without {")
+			}
+			braces--
+		}
+	}
+	if braces > 0 {
+		return fmt.Errorf("{ without }")
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var classTests = []struct {
+	pattern string
+	matches []string
+	misses  []string
+}{
+	{"*.[ch]", []string{"a.c", "a.h"}, []string{"a.go", "a.ch"}},
+	{"[0-9]*.log", []string{"1.log", "12.log"}, []string{"x.log", "ab.log"}},
+	{"[!_]*.go", []string{"a.go", "x.go"}, []string{"_x.go", "a.c"}},
+	{"?.log", []string{"1.log", "x.log"}, []string{"12.log", "ab.log"}},
+}
+
+// classFiles are the files classTests are globbed against.
+var classFiles = []string{"a.c", "a.h", "a.go", "x.go", "_x.go", "1.log", "12.log", "x.log", "ab.log"}
+
+func TestZglobClassesMatch(t *testing.T) {
+	for _, test := range classTests {
+		for _, name := range test.matches {
+			if ok, err := (zglobber{}).Match(test.pattern, name); err != nil || !ok {
+				t.Errorf("%s doesn't match %s: %v", test.pattern, name, err)
+			}
+		}
+		for _, name := range test.misses {
+			if ok, err := (zglobber{}).Match(test.pattern, name); err != nil || ok {
+				t.Errorf("%s matches %s: %v", test.pattern, name, err)
+			}
+		}
+	}
+}
+
+func TestZglobClassesGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range classFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range classTests {
+		found, err := (zglobber{}).Glob(filepath.Join(dir, test.pattern))
+		if err != nil {
+			t.Errorf("can't glob %s: %s", test.pattern, err)
+			continue
+		}
+		names := make([]string, len(found))
+		for i, f := range found {
+			names[i] = filepath.Base(f)
+		}
+		sort.Strings(names)
+		want := append([]string{}, test.matches...)
+		sort.Strings(want)
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s finds %v, want %v", test.pattern, names, want)
+		}
+	}
+}
+
+func TestDoublestarClasses(t *testing.T) {
+	for _, test := range classTests {
+		for _, name := range test.matches {
+			if ok, err := (doublestarGlobber{}).Match(test.pattern, name); err != nil || !ok {
+				t.Errorf("%s doesn't match %s: %v", test.pattern, name, err)
+			}
+		}
+		for _, name := range test.misses {
+			if ok, err := (doublestarGlobber{}).Match(test.pattern, name); err != nil || ok {
+				t.Errorf("%s matches %s: %v", test.pattern, name, err)
+			}
+		}
+	}
+}
+
+func TestMalformedPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(regex bool) { *useRegex = regex }(*useRegex)
+	path := filepath.Join(dir, "patterns")
+
+	tests := []struct {
+		name     string
+		regex    bool
+		patterns string
+		ignore   string
+		want     string
+	}{
+		{
+			name:     "unclosed [",
+			patterns: "src/*.go\n# generated\nsrc/[ab.go\n",
+			want:     path + ":3: bad pattern src/[ab.go: [ without ]",
+		},
+		{
+			name:     "unclosed {",
+			patterns: "src/*.{go,mod\n",
+			want:     path + ":1: bad pattern src/*.{go,mod: { without }",
+		},
+		{
+			name:     "stray }",
+			patterns: "src/*.go\n\n!vendor}/**\n",
+			want:     path + ":3: bad pattern !vendor}/**: } without {",
+		},
+		{
+			name:     "empty class",
+			patterns: "src/[!]*.go\n",
+			want:     path + ":1: bad pattern src/[!]*.go: empty character class",
+		},
+		{
+			name:     "bad regex",
+			regex:    true,
+			patterns: `\.go$` + "\n" + `(\.mod$` + "\n",
+			want:     path + `:2: bad pattern (\.mod$: error parsing regexp: missing closing ): ` + "`(\\.mod$`",
+		},
+		{
+			name:   "ignore file",
+			ignore: "# build output\ndist/\n*.{tmp\n",
+			want:   ignoreFileName + ":3: bad pattern *.{tmp: { without }",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*useRegex = test.regex
+			var err error
+			if test.ignore != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte(test.ignore), 0644); err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(filepath.Join(dir, ignoreFileName))
+				_, err = readIgnoreFile(dir)
+			} else {
+				if err := ioutil.WriteFile(path, []byte(test.patterns), 0644); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err = readPatternsFile(path)
+			}
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got error %v, want %s", err, test.want)
+			}
+		})
+	}
+}
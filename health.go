@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// healthInterval is how often -health-url is asked while waiting for it.
+const healthInterval = 250 * time.Millisecond
+
+var healthClient = &http.Client{Timeout: time.Second}
+
+// checkHealth polls -health-url from the start of a run until it answers
+// 200, and logs how long that took or that it didn't within
+// -health-timeout. Otherwise a server that starts but never gets ready looks
+// just like a working one. Cancelling ctx, on a restart or when the command
+// exits, stops the check.
+func checkHealth(ctx context.Context, run int64) {
+	start := time.Now()
+	deadline := time.After(*healthTimeout)
+	for {
+		err := healthy(ctx)
+		if err == nil {
+			log.Printf("healthy after %s: %s", time.Since(start).Round(time.Millisecond), *healthURL)
+			emitJSON(jsonRecord{Type: "healthy", Run: run, Duration: time.Since(start).Seconds()})
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Printf("not healthy after %s: %s", *healthTimeout, err)
+			emitJSON(jsonRecord{Type: "unhealthy", Run: run, Duration: time.Since(start).Seconds(), Error: err.Error()})
+			return
+		case <-time.After(healthInterval):
+		}
+	}
+}
+
+func healthy(ctx context.Context) error {
+	req, err := http.NewRequest("GET", *healthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", *healthURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// getFileID isn't supported on Windows, -inodes falls back to paths.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
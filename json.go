@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonVersion is bumped whenever a field of jsonRecord changes meaning or
+// goes away. New fields can be added without bumping it.
+const jsonVersion = 1
+
+// jsonRecord is one line of -json output. Type is change, start, output,
+// exit, watch-error, or healthy or unhealthy for -health-url, and only the
+// fields that make sense for it are set.
+type jsonRecord struct {
+	Version  int       `json:"v"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Run      int64     `json:"run,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Line     string    `json:"line,omitempty"`
+	Code     *int      `json:"code,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var jsonOut = struct {
+	sync.Mutex
+	enc *json.Encoder
+}{enc: json.NewEncoder(os.Stdout)}
+
+// emitJSON writes r to stdout in -json mode and does nothing otherwise.
+func emitJSON(r jsonRecord) {
+	if !*jsonOutput {
+		return
+	}
+	r.Version = jsonVersion
+	r.Time = time.Now()
+	jsonOut.Lock()
+	defer jsonOut.Unlock()
+	if err := jsonOut.enc.Encode(r); err != nil {
+		log.Printf("can't write json record: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// limit is a -max-parallel-per-pattern entry: at most max -serialize-by runs
+// for files matching pattern at a time.
+type limit struct {
+	pattern string
+	max     int
+	slots   chan struct{}
+}
+
+// limitList collects every -max-parallel-per-pattern flag.
+type limitList []*limit
+
+var limits limitList
+
+func (l *limitList) String() string {
+	entries := make([]string, len(*l))
+	for i, lim := range *l {
+		entries[i] = fmt.Sprintf("%s=%d", lim.pattern, lim.max)
+	}
+	return strings.Join(entries, ", ")
+}
+
+func (l *limitList) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("limit must look like pattern=N: %s", value)
+	}
+	max, err := strconv.Atoi(value[i+1:])
+	if err != nil || max < 1 {
+		return fmt.Errorf("limit must be a positive number: %s", value)
+	}
+	*l = append(*l, &limit{pattern: value[:i], max: max, slots: make(chan struct{}, max)})
+	return nil
+}
+
+func (l *limitList) reset() {
+	*l = nil
+}
+
+func init() {
+	flags.Var(&limits, "max-parallel-per-pattern", "run at most N -serialize-by runs for files matching a pattern at the same time, given as pattern=N, may be repeated")
+}
+
+// resolveLimits makes the patterns of limits comparable to changed files,
+// the same way -filenames patterns are.
+func resolveLimits() error {
+	for _, lim := range limits {
+		if *useRegex {
+			if err := compilePatterns([]string{lim.pattern}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isBasePattern(lim.pattern) && !filepath.IsAbs(lim.pattern) {
+			lim.pattern = filepath.Clean(filepath.Join(baseDir, lim.pattern))
+		}
+	}
+	return nil
+}
+
+// limitFor returns the first limit with a pattern matching one of files, nil
+// if there is none and the run isn't limited.
+func limitFor(files []string) *limit {
+	for _, lim := range limits {
+		for _, f := range files {
+			if ok, _ := matchPattern(lim.pattern, f); ok {
+				return lim
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// lockSupported is false on Windows, there's no flock. -lockfile is rejected
+// at startup rather than failing every run.
+const lockSupported = false
+
+// tryLock isn't supported on Windows.
+func tryLock(f *os.File) (bool, error) {
+	return false, errors.New("-lockfile isn't supported on Windows")
+}
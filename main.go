@@ -3,167 +3,3105 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	zglob "github.com/mattn/go-zglob"
 )
 
-var fileNames = flag.String("filenames", "", "files to watch separated by commas")
-var debounceInterval = flag.Int("t", 0, "debounce interval")
-var verbose = flag.Bool("verbose", false, "verbose mode")
-var command = flag.String("command", "", "command to execute")
-var initial = flag.Bool("initial", false, "run command before any change happens")
+// stdout and stderr are where Run was told to write to. Commands' own
+// output, JSON records and the log go there.
+var stdout, stderr io.Writer = os.Stdout, os.Stderr
+
+var fileNames = flags.String("filenames", "", "files to watch separated by commas (default everything below -base)")
+var verbose = flags.Bool("verbose", false, "verbose mode")
+var verbosity = flags.Int("v", 0, "verbosity level, 1 is -verbose, 2 also logs every pattern match attempt")
+var initial = flags.Bool("initial", false, "run command before any change happens")
+var noRestart = flags.Bool("no-restart", false, "let a running command finish instead of restarting it, changes made meanwhile are debounced once it's done")
+var useRegex = flags.Bool("regex", false, "treat -filenames as regular expressions matched against absolute paths")
+var filesOnly = flags.Bool("files-only", false, "don't watch the parent directory of each watched file")
+var heartbeat = flags.Duration("heartbeat", 0, "log a line every interval to show filewatch is still running, e.g. 1m (disabled by default)")
+var retries = flags.Int("retries", 0, "retry a failed run up to this many times, -1 retries until it succeeds")
+var retryDelay = flags.Duration("retry-delay", time.Second, "time to wait before retrying a failed run")
+var noInitialRetry = flags.Bool("no-initial-command-if-failed", false, "don't retry a failed -initial run, wait for a change instead")
+var inheritIO = flags.Bool("inherit-io", false, "connect the command directly to filewatch's stdout and stderr instead of logging its output line by line")
+var successCodes = flags.String("success-codes", "0", "exit codes treated as success separated by commas")
+var eventBuffer = flags.Int("event-buffer", 100, "number of matched events queued while a previous one is being handled")
+var printCommand = flags.Bool("print-command", false, "print each command right before running it")
+var base = flags.String("base", "", "directory relative patterns and the ignore file are resolved against (default the working directory)")
+var relative = flags.Bool("relative", false, "match patterns against paths relative to -base instead of absolute ones")
+var buffer = flags.Duration("buffer", 10*time.Millisecond, "merge identical consecutive events for the same file arriving within this window")
+var serializeBy = flags.String("serialize-by", "", "run the command once per changed file or dir, serializing runs for the same one: file or dir")
+var waitComplete = flags.Bool("wait-complete", false, "like -no-restart, but a run starts as soon as the previous one is done if the quiet period since the last change has already passed")
+var onStart = flags.String("on-start", "", "command to run once watching has started")
+var onExit = flags.String("on-exit", "", "command to run once when filewatch exits, including on SIGINT and SIGTERM")
+var gitBranchAware = flags.Bool("git-branch-aware", false, "when .git/HEAD in -base changes, wait for -git-settle without changes before running")
+var gitSettle = flags.Duration("git-settle", 3*time.Second, "quiet period after a branch switch in -git-branch-aware mode")
+var summary = flags.Bool("summary", false, "log the exit code, duration and triggering files after each run")
+var maxWait = flags.Duration("max-wait", 0, "run at the latest this long after the first change even if changes keep coming (disabled by default)")
+var onRemove = flags.String("on-remove", "", "command to run for each removed file instead of -command, {file} is the removed path")
+var matchBase = flags.Bool("match-base", false, "match patterns without a slash against the file name only, anywhere under -base")
+var strict = flags.Bool("strict", false, "exit if a command can't be started instead of waiting for the next change")
+var reloadFileNames = flags.String("reload-filenames", "", "files whose changes run -reload-command instead of restarting -command, separated by commas")
+var reloadCommand = flags.String("reload-command", "", "command to run for changes matching only -reload-filenames")
+var maxFileSize = flags.String("max-file-size", "", "size above which files get the -large-files treatment, e.g. 500MB (no limit by default)")
+var largeFiles = flags.String("large-files", "ignore", "what to do with changes to files above -max-file-size: ignore or trigger without further checks")
+var initialBlocking = flags.Bool("initial-blocking", false, "like -initial, but run the command to completion before setting up watches, so its own output files don't trigger it")
+var socketPath = flags.String("socket", "", "create a Unix domain socket at this path and write every debounced change to it as a JSON line")
+var dirsOnly = flags.Bool("dirs-only", false, "watch only directories, never individual files, to use as few watches as possible")
+var crashInterval = flags.Duration("crash-interval", 0, "debounce interval to use instead of -t when the previous run failed")
+var printChanged = flags.Bool("print-changed", false, "print the changed files to stdout, one per line, after each debounced change and keep watching")
+var delay = flags.Duration("delay", 0, "wait this long after the debounce before running, a change meanwhile starts over")
+var ignoreDuringRun = flags.Bool("ignore-during-run", false, "drop all changes made while the command is running")
+var strategyName = flags.String("strategy", "debounce", "when a change leads to a run: debounce waits for -t without changes, throttle runs at once and at most every -t, batch runs every -t with what changed, adaptive waits -t per changed file up to -adaptive-max, immediate runs on every event, dir waits -t without changes in each directory on its own")
+var lazy = flags.Bool("lazy", false, "watch the directories the patterns point into right away and match files only as they change, instead of globbing everything at startup")
+var noCommandOutput = flags.Bool("no-command-output", false, "discard the command's output and only log its exit status")
+var trackInodes = flags.Bool("inodes", false, "also match events by file identity, for files reachable through several paths like bind mounts")
+var recurseUnder = flags.String("recurse-under", "", "only start watching new directories below these, separated by commas (default anywhere)")
+var bufferOutput = flags.Bool("buffer-output", false, "collect each command's output and print it in one piece once the command is done")
+var onlyIf = flags.String("only-if", "", "command that has to exit with 0 for a change to be run at all")
+var maxRuntime = flags.Duration("max-runtime", 0, "exit with 0 after running this long, giving a running command 10s to finish first (disabled by default)")
+var patternsFile = flags.String("patterns-file", "", "file with one -filenames pattern per line, lines starting with ! are excludes")
+var idleTimeout = flags.Duration("idle-timeout", 0, "kill a command that hasn't written a line of output for this long (disabled by default)")
+var jsonOutput = flags.Bool("json", false, "write changes, command starts, output lines, exits and watch errors to stdout as JSON lines")
+var adaptiveMax = flags.Duration("adaptive-max", 10*time.Second, "longest quiet period the adaptive strategy waits for, however many files change")
+var excludeDirs = flags.String("exclude-dir", "", "directories never to watch along with everything below them, like .git,node_modules, separated by commas")
+var notifyInterval = flags.Duration("notify-t", 0, "debounce interval for -print-changed, -socket and -json change records, separate from -t (default notify along with each run)")
+var watchErrorCode = flags.Int("watch-error-code", 1, "exit code to use when watching fails, to tell it apart from the command's")
+var matchDirs = flags.Bool("match-dirs", false, "also run when a directory is created or removed where the patterns look for files")
+var logFile = flags.String("log-file", "", "also write command output to this file, {runid} or {time} in the name give every run a file of its own")
+var logKeep = flags.Int("log-keep", 0, "remove all but this many of the newest files a templated -log-file expands to (default keep all)")
+var collapseOutput = flags.Bool("collapse-output", false, "print a short note instead of a command's output if it's the same as on the previous run")
+var literal = flags.Bool("literal", false, "take -filenames as exact paths rather than globs, for names with characters like [ or *")
+var detach = flags.Bool("detach", false, "start the command and move on, without waiting for it, capturing its output or killing it on the next change")
+var webhook = flags.String("webhook", "", "URL to POST every debounced change to as JSON")
+var webhookRetries = flags.Int("webhook-retries", 0, "retry a failed -webhook request up to this many times, waiting twice as long each time from 1s")
+var renameAware = flags.Bool("rename-aware", false, "pair renames with the create that follows, so a matched file moved elsewhere is reported under its new name")
+var maxChanges = flags.Int("max-changes", 10000, "most changed files collected for a single run, more are only counted")
+var outputs = flags.String("output", "", "files the command writes, whose changes never trigger it, separated by commas")
+var cwd = flags.String("cwd", "", "directory to run commands in, relative to -base (default the working directory)")
+var gracePeriod = flags.Duration("grace-period", 0, "time to wait after killing a running command before starting it again")
+var minSizeChange = flags.String("min-size-change", "", "only pass on writes that change a file's size by more than this, e.g. 4KB or 10%")
+var relativeOutput = flags.Bool("relative-output", false, "rewrite absolute paths below -base in command output to relative ones")
+var pollMounts = flags.Duration("poll-mounts", 0, "poll directories on other filesystems than -base at this interval instead of watching them (disabled by default)")
+var noDebounce = flags.Bool("no-debounce", false, "run on every matching event right away, same as -strategy immediate")
+var sshHost = flags.String("ssh", "", "run commands on this host through ssh, as [user@]host")
+var remoteDir = flags.String("remote-dir", "", "directory on the -ssh host that corresponds to -base, commands run there and placeholders are mapped to it")
+var firstMatchOnly = flags.Bool("first-match-only", false, "forward an event matching several -filenames patterns only once, for the first of them")
+var depth = flags.Int("depth", -1, "watch at most this many directory levels below where a pattern's wildcards start, 0 for that directory only (default no limit)")
+var matcherName = flags.String("matcher", "zglob", "glob engine for -filenames and excludes: zglob, or doublestar for configs written for bmatcuk/doublestar")
+var mergeOutput = flags.Bool("merge-output", false, "read a command's stdout and stderr as one stream, keeping the order of their lines but not the [STDERR] marks")
+var watchIgnoreFile = flags.Bool("watch-ignore-file", false, "reload the patterns when the ignore file in -base changes, adding and removing watches to match")
+var tag = flags.String("tag", "", "prefix every line filewatch logs with this, commands' output included, to tell several instances apart")
+var healthURL = flags.String("health-url", "", "URL that answers 200 once a run's server is ready, polled from the start of every run")
+var healthTimeout = flags.Duration("health-timeout", 30*time.Second, "how long -health-url gets to answer 200 before the run is logged as unhealthy")
+var root = flags.String("root", "", "drop events for paths outside this directory, relative to -base (default the directory holding -base and all -filenames patterns)")
+var coalesceWindow = flags.Duration("coalesce-window", 25*time.Millisecond, "merge the writes to a file arriving within this window into one event before matching, 0 to disable")
+var lockFile = flags.String("lockfile", "", "hold an advisory lock on this file while the commands run, waiting for other processes holding it")
+var lockSkip = flags.Bool("lock-skip", false, "skip a run if -lockfile is locked instead of waiting for it")
+var bell = flags.String("bell", "", "ring the terminal bell after every run: always, or failure for failed runs only")
+var stableTime = flags.Duration("stable-time", 0, "pass on a write only once the file's size hasn't changed for this long, for files written over a while like uploads (disabled by default)")
+var parallel = flags.Bool("parallel", false, "run repeated -command flags concurrently instead of one after another")
+
+var commands commandList
+var debounceInterval = debounceFlag{perOp: make(map[fsnotify.Op]time.Duration)}
+
+func init() {
+	flags.Var(&commands, "command", "command to execute, may be repeated")
+	flags.Var(&debounceInterval, "t", "debounce interval in seconds or as a duration, optionally per event type like 1s,write=200ms,create=2s")
+	flags.Var(&rewrites, "rewrite-output", "replace text in command output, given as old=new, may be repeated")
+}
+
+// commandList collects every -command flag in the order given.
+type commandList []string
+
+func (c *commandList) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *commandList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+func (c *commandList) reset() {
+	*c = nil
+}
+
+// rewriteList collects every -rewrite-output flag as old, new pairs.
+type rewriteList []string
+
+var rewrites rewriteList
+
+func (r *rewriteList) String() string {
+	return strings.Join(*r, ", ")
+}
+
+func (r *rewriteList) reset() {
+	*r = nil
+}
+
+func (r *rewriteList) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("rewrite must look like old=new: %s", value)
+	}
+	*r = append(*r, value[:i], value[i+1:])
+	return nil
+}
+
+// outputRewriter applies -rewrite-output and -relative-output to command
+// output, nil if there's nothing to rewrite.
+var outputRewriter *strings.Replacer
+
+func rewriteOutput(line string) string {
+	if outputRewriter == nil {
+		return line
+	}
+	return outputRewriter.Replace(line)
+}
+
+var opNames = map[string]fsnotify.Op{
+	"create": fsnotify.Create,
+	"write":  fsnotify.Write,
+	"remove": fsnotify.Remove,
+	"rename": fsnotify.Rename,
+	"chmod":  fsnotify.Chmod,
+}
+
+// debounceFlag is the -t interval, with optional overrides per event type.
+type debounceFlag struct {
+	interval time.Duration
+	perOp    map[fsnotify.Op]time.Duration
+}
+
+func (d *debounceFlag) String() string {
+	parts := []string{d.interval.String()}
+	for name, op := range opNames {
+		if interval, ok := d.perOp[op]; ok {
+			parts = append(parts, name+"="+interval.String())
+		}
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
+
+func (d *debounceFlag) reset() {
+	d.interval, d.perOp = 0, make(map[fsnotify.Op]time.Duration)
+}
+
+func (d *debounceFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		name, interval := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			name, interval = part[:i], part[i+1:]
+		}
+		parsed, err := parseInterval(interval)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			d.interval = parsed
+			continue
+		}
+		op, ok := opNames[name]
+		if !ok {
+			return fmt.Errorf("unknown event type: %s", name)
+		}
+		d.perOp[op] = parsed
+	}
+	return nil
+}
+
+// forOp returns the interval for an event, the longest one if its op
+// combines several types.
+func (d *debounceFlag) forOp(op fsnotify.Op) time.Duration {
+	interval, found := time.Duration(0), false
+	for _, o := range opNames {
+		if op&o == o {
+			if i, ok := d.perOp[o]; ok && (!found || i > interval) {
+				interval, found = i, true
+			}
+		}
+	}
+	if !found {
+		return d.interval
+	}
+	return interval
+}
+
+// parseInterval accepts plain seconds, as -t always did, or a duration.
+func parseInterval(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse interval: %s", value)
+	}
+	return interval, nil
+}
 
 var watch *fsnotify.Watcher
 
+// clock is how the event pipeline tells time. It's only replaced to drive
+// the debounce logic without real sleeps.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var clk clock = realClock{}
+
+// stats is shared between the watcher goroutine and whatever reports on it.
+var stats struct {
+	sync.Mutex
+	watched map[string]bool
+	// dirs are the watched directories, for telling what a removed path was.
+	dirs      map[string]bool
+	lastEvent time.Time
+	// events is the number of matched events so far.
+	events int
+	// running is the number of runCommands calls in progress.
+	running int
+	// lastRunFailed is whether the last finished run failed, retries
+	// included.
+	lastRunFailed bool
+}
+
+// onWatchChange is told about paths added to or dropped from the watch set,
+// including the ones added and dropped dynamically as directories come and
+// go. It may be nil.
+var onWatchChange func(added []string, removed []string)
+
 func addFilesToWatch(files []string) error {
+	added := make([]string, 0)
+	defer func() {
+		if onWatchChange != nil && len(added) > 0 {
+			onWatchChange(added, nil)
+		}
+	}()
+
 	for _, f := range files {
 		stat, err := os.Stat(f)
 		if err != nil {
 			return fmt.Errorf("can't get stat for file: %s, %s", f, err)
 		}
+		// The directory holding a symlink sees it being relinked, the
+		// watch on the link itself follows the old target.
+		if rememberSymlink(f) {
+			if err := addWatch(filepath.Dir(filepath.Clean(f)), &added); err != nil {
+				return err
+			}
+		}
+		// Pipes, sockets and devices can block or fail in odd ways when the
+		// watcher opens them, and they don't change like files do anyway.
+		if !stat.IsDir() && !stat.Mode().IsRegular() {
+			log.Printf("skipping special file: %s (%s)", f, stat.Mode())
+			continue
+		}
+		// A directory watch reports changes to every file in it, so that's
+		// all -dirs-only needs.
+		if *dirsOnly && !stat.IsDir() {
+			f = path.Dir(f)
+		}
+
+		if err := addWatch(f, &added); err != nil {
+			return err
+		}
+		// Watching the parent as well catches editors that save by writing a
+		// new file and renaming it over the old one.
+		if !stat.IsDir() && !*filesOnly && !*dirsOnly {
+			if err := addWatch(path.Dir(f), &added); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addWatch watches name unless it's watched already, and appends it to added
+// if it wasn't.
+func addWatch(name string, added *[]string) error {
+	name = filepath.Clean(name)
+	stats.Lock()
+	watched := stats.watched[name]
+	stats.Unlock()
+	if watched {
+		return nil
+	}
+
+	if pollInstead(name) {
+		stats.Lock()
+		stats.watched[name] = true
+		stats.Unlock()
+		*added = append(*added, name)
+		return nil
+	}
+	if err := watch.Add(name); err != nil {
+		return fmt.Errorf("can't add file to watch: %s, %s", name, err)
+	}
+	stat, err := os.Stat(name)
+	stats.Lock()
+	stats.watched[name] = true
+	if err == nil && stat.IsDir() {
+		stats.dirs[name] = true
+	}
+	stats.Unlock()
+	*added = append(*added, name)
+	return nil
+}
+
+// symlinks maps watched symlinks to the target they pointed to when last
+// looked at.
+var symlinks = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// rememberSymlink records name's target if it's a symlink, and reports
+// whether it is one.
+func rememberSymlink(name string) bool {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	stat, err := os.Lstat(name)
+	if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	symlinks.Lock()
+	symlinks.m[name] = target
+	symlinks.Unlock()
+	return true
+}
+
+// relinked reports whether name is a watched symlink that now points
+// somewhere else, like a "current" link swapped to a new release, and
+// remembers the new target.
+func relinked(name string) bool {
+	symlinks.Lock()
+	old, ok := symlinks.m[name]
+	symlinks.Unlock()
+	if !ok {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil || target == old {
+		return false
+	}
+	symlinks.Lock()
+	symlinks.m[name] = target
+	symlinks.Unlock()
+	log.Printf("symlink relinked: %s -> %s", name, target)
+	return true
+}
+
+// rewatch replaces the watches on name and below it, which still follow the
+// old symlink target, with watches on what ws matches there now.
+func rewatch(name string, ws watchSet) {
+	stats.Lock()
+	stale := make([]string, 0)
+	for w := range stats.watched {
+		if abs, err := filepath.Abs(w); err == nil && isUnder(abs, name) {
+			stale = append(stale, w)
+		}
+	}
+	stats.Unlock()
+	for _, w := range stale {
+		watch.Remove(w)
+		forgetWatch(w)
+	}
+
+	// The new target gets what the watch set would have watched there at
+	// startup, with the same patterns, excludes and limits.
+	files, err := expandWatchSet(ws)
+	if err != nil {
+		log.Printf("can't watch relinked symlink: %s", err)
+		return
+	}
+	fresh := make([]string, 0)
+	for _, f := range files {
+		if abs, err := filepath.Abs(f); err == nil && isUnder(abs, name) {
+			fresh = append(fresh, f)
+		}
+	}
+	if err := addFilesToWatch(fresh); err != nil {
+		log.Printf("can't watch relinked symlink: %s", err)
+	}
+}
+
+// forgetWatch drops name from the watch set after it was removed or renamed,
+// and reports whether it was a directory. fsnotify stops watching it by
+// itself.
+func forgetWatch(name string) bool {
+	stats.Lock()
+	watched, dir := stats.watched[name], stats.dirs[name]
+	delete(stats.watched, name)
+	delete(stats.dirs, name)
+	stats.Unlock()
+	if watched && onWatchChange != nil {
+		onWatchChange(nil, []string{name})
+	}
+	return dir
+}
+
+const ignoreFileName = ".filewatchignore"
+
+// readIgnoreFile loads exclude patterns from the ignore file in dir, if there
+// is one. Patterns are one per line, blank lines and lines starting with # are
+// skipped. A pattern without a slash matches at any depth, like .gitignore.
+func readIgnoreFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open ignore file: %s", err)
+	}
+	defer f.Close()
+
+	excludes := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := checkPattern(line, false); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad pattern %s: %s", ignoreFileName, n, line, err)
+		}
+		excludes = append(excludes, excludePattern(line, dir))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read ignore file: %s", err)
+	}
+	return excludes, nil
+}
+
+// readPatternsFile loads patterns to watch from path, one per line, along
+// with the excludes given as !-prefixed lines. Excludes are resolved like the
+// ignore file's.
+func readPatternsFile(path string) ([]string, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open patterns file: %s", err)
+	}
+	defer f.Close()
+
+	includes := make([]string, 0)
+	excludes := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		include := !strings.HasPrefix(line, "!")
+		if err := checkPattern(strings.TrimPrefix(line, "!"), include); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: bad pattern %s: %s", path, n, line, err)
+		}
+		if include {
+			includes = append(includes, line)
+			continue
+		}
+		excludes = append(excludes, excludePattern(strings.TrimPrefix(line, "!"), baseDir))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("can't read patterns file: %s", err)
+	}
+	return includes, excludes, nil
+}
+
+// excludePattern resolves an exclude the way .gitignore does: a pattern
+// without a slash matches at any depth below dir, one with a slash relative
+// to dir.
+func excludePattern(pattern string, dir string) string {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return filepath.Join(dir, pattern)
+}
+
+// isExcluded reports whether name or any of its parent directories matches
+// one of the exclude patterns, so excluding a directory covers its contents.
+func isExcluded(excludes []string, name string) bool {
+	for p := name; ; p = filepath.Dir(p) {
+		for _, pattern := range excludes {
+			if ok, _ := globMatch(pattern, p); ok {
+				return true
+			}
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+	}
+}
+
+// regexps holds the compiled -filenames patterns in -regex mode. It is filled
+// at startup and again when the patterns are reloaded.
+var regexps = struct {
+	sync.RWMutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+func compilePatterns(patterns []string) error {
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("can't compile pattern: %s %s", p, err)
+		}
+		regexps.Lock()
+		regexps.m[p] = re
+		regexps.Unlock()
+	}
+	return nil
+}
+
+// baseDir is the absolute form of -base, set once in main.
+var baseDir string
+
+// relativePath makes p relative to baseDir, leaving it as is if that's not
+// possible.
+func relativePath(p string) string {
+	rel, err := filepath.Rel(baseDir, p)
+	if err != nil {
+		return p
+	}
+	return rel
+}
+
+// isBasePattern reports whether pattern is matched against file names only.
+// Every other glob pattern has been made absolute by then.
+func isBasePattern(pattern string) bool {
+	return *matchBase && !*useRegex && !*literal && !strings.ContainsRune(pattern, filepath.Separator)
+}
+
+// matchPattern matches name against a glob pattern, or against a regular
+// expression in -regex mode. With -relative both sides are taken relative to
+// baseDir first, so the same pattern works wherever the tree is checked out.
+func matchPattern(pattern string, name string) (bool, error) {
+	if *literal {
+		return pattern == name, nil
+	}
+	if isBasePattern(pattern) {
+		return globMatch(pattern, filepath.Base(name))
+	}
+	if *relative {
+		name = relativePath(name)
+		if !*useRegex {
+			pattern = relativePath(pattern)
+		}
+	}
+	if !*useRegex {
+		return globMatch(pattern, name)
+	}
+	regexps.RLock()
+	re, ok := regexps.m[pattern]
+	regexps.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("pattern wasn't compiled: %s", pattern)
+	}
+	return re.MatchString(name), nil
+}
+
+// walk is filepath.Walk, tests swap it to see where expansion looks.
+var walk = filepath.Walk
+
+// expandPattern lists existing paths matching pattern that aren't excluded.
+// Regular expressions can't narrow down where to look, so in -regex mode the
+// whole base directory is walked and filtered. Globs go to the glob engine,
+// unless there are excludes: then the directory their literal part names is
+// walked instead, so excluded directories are skipped rather than listed and
+// thrown away.
+func expandPattern(pattern string, root string, excludes []string) ([]string, error) {
+	if *literal {
+		if _, err := os.Lstat(pattern); err != nil || isExcluded(excludes, pattern) {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	// Without a ** or braces, which may hold slashes, a glob can't match
+	// deeper than it has parts.
+	levels := -1
+	if !*useRegex {
+		i := strings.IndexAny(pattern, "*?[{")
+		if i < 0 || len(excludes) == 0 {
+			matches, err := globExpand(pattern)
+			if err != nil {
+				return nil, err
+			}
+			kept := make([]string, 0, len(matches))
+			for _, match := range matches {
+				if !isExcluded(excludes, match) {
+					kept = append(kept, match)
+				}
+			}
+			return kept, nil
+		}
+		root = filepath.Dir(pattern[:i])
+		if !strings.Contains(pattern, "**") && !strings.Contains(pattern, "{") {
+			levels = strings.Count(pattern[len(root):], string(filepath.Separator))
+		}
+	}
+	matches := make([]string, 0)
+	// The separator has the root followed if it's a symlink.
+	err := walk(root+string(filepath.Separator), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Like the glob engines, which pass over what they
+			// can't read.
+			if !*useRegex {
+				return nil
+			}
+			return err
+		}
+		p = filepath.Clean(p)
+		if isExcluded(excludes, p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ok, err := matchPattern(pattern, p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, p)
+		}
+		if info.IsDir() && levels >= 0 && p != root {
+			if rel, err := filepath.Rel(root, p); err == nil && strings.Count(rel, string(filepath.Separator))+1 >= levels {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// gitHead is the .git/HEAD file watched in -git-branch-aware mode.
+var gitHead string
+
+func isGitHead(name string) bool {
+	return gitHead != "" && name == gitHead
+}
+
+// quietPeriod is how long debounceThen still has to wait for the next event.
+// Normally it's the full interval from the event just read, but with
+// -wait-complete events may have waited in the buffer during a run, so the
+// interval counts from when the last one actually happened.
+func quietPeriod(interval time.Duration) time.Duration {
+	if !*waitComplete {
+		return interval
+	}
+	stats.Lock()
+	lastEvent := stats.lastEvent
+	stats.Unlock()
+	return interval - clk.Now().Sub(lastEvent)
+}
+
+// eventInterval is the debounce interval an event asks for. A branch switch
+// rewrites lots of files, so a HEAD change stretches it to -git-settle.
+func eventInterval(event fsnotify.Event) time.Duration {
+	interval := debounceInterval.forOp(event.Op)
+	if isGitHead(event.Name) && *gitSettle > interval {
+		if *verbose {
+			log.Printf("branch switch detected, waiting %s for changes to settle", *gitSettle)
+		}
+		return *gitSettle
+	}
+	return interval
+}
+
+// debounceThen waits for an event and then for a quiet period without any,
+// or -max-wait past the first one, and calls cb with everything that arrived
+// in between.
+func debounceThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	debounceScaled(events, cb, func(interval time.Duration, files int) time.Duration {
+		return interval
+	})
+}
+
+// debounceScaled is debounceThen with a quiet period that scale derives from
+// the interval and the number of distinct files changed so far.
+func debounceScaled(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event), scale func(interval time.Duration, files int) time.Duration) {
+	event, ok := <-events
+	if !ok {
+		return
+	}
+	changed := newChangeSet(event)
+	var deadline <-chan time.Time
+	if *maxWait > 0 {
+		deadline = clk.After(*maxWait)
+	}
+	// A storm of creates from a branch switch may need longer to settle than
+	// a single write, so the longest interval of the events seen wins.
+	interval := eventInterval(event)
+	// Restarting a server that just crashed within moments is how crash
+	// loops happen, so give the fix a little longer to land.
+	stats.Lock()
+	failed := stats.lastRunFailed
+	stats.Unlock()
+	if failed && *crashInterval > interval {
+		interval = *crashInterval
+	}
+	if *verbose {
+		log.Printf("event: %s, wait for next\n", event)
+	}
+
+LOOP:
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				break LOOP
+			}
+			changed.add(event)
+			if i := eventInterval(event); i > interval {
+				interval = i
+			}
+			if *verbose {
+				log.Printf("event: %s, wait for next\n", event)
+			}
+		case <-clk.After(quietPeriod(scale(interval, len(changed.events)))):
+			break LOOP
+		case <-deadline:
+			if *verbose {
+				log.Printf("changes keep coming, running after -max-wait %s", *maxWait)
+			}
+			break LOOP
+		}
+	}
+	cb(changed.events)
+}
+
+// removals queues matched Remove events in -on-remove mode, nil otherwise.
+// Unlike the event buffer it never drops one, every removed file gets its
+// run, and queueing never holds up the watcher.
+var removals *removalQueue
+
+type removalQueue struct {
+	sync.Mutex
+	events []fsnotify.Event
+	// ready has a value while events may be waiting.
+	ready chan struct{}
+}
+
+func newRemovalQueue() *removalQueue {
+	return &removalQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *removalQueue) add(event fsnotify.Event) {
+	q.Lock()
+	q.events = append(q.events, event)
+	q.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest queued event, false if there is none.
+func (q *removalQueue) next() (fsnotify.Event, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.events) == 0 {
+		return fsnotify.Event{}, false
+	}
+	event := q.events[0]
+	q.events = q.events[1:]
+	return event, true
+}
+
+// handleRemovals runs -on-remove for every removed file, one at a time, so
+// removing a whole tree doesn't start hundreds of commands at once.
+func handleRemovals(ctx context.Context, q *removalQueue) {
+	for {
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return
+		}
+		for ctx.Err() == nil {
+			event, ok := q.next()
+			if !ok {
+				break
+			}
+			runCommand(ctx, expandSetEnv(*onRemove), "[on-remove] ", trigger{files: []string{event.Name}, time: clk.Now()}, false)
+		}
+	}
+}
+
+// maxFileBytes is -max-file-size in bytes, 0 if unset.
+var maxFileBytes int64
+
+// parseSize parses a byte count with an optional KB, MB or GB suffix.
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	value = strings.ToUpper(strings.TrimSpace(value))
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("can't parse size: %s", value)
+			}
+			return n * u.size, nil
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse size: %s", value)
+	}
+	return n, nil
+}
+
+// isLargeFile reports whether name is a regular file above -max-file-size.
+// Files that can't be stat'ed, like removed ones, aren't large.
+func isLargeFile(name string) bool {
+	stat, err := os.Stat(name)
+	return err == nil && stat.Mode().IsRegular() && stat.Size() > maxFileBytes
+}
+
+// minSizeBytes and minSizePercent are -min-size-change, one of them set.
+var minSizeBytes int64
+var minSizePercent float64
+
+// sizes are the sizes of the matched files as of their last change that was
+// passed on, for -min-size-change.
+var sizes = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+func parseSizeChange(value string) error {
+	if strings.HasSuffix(value, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || p < 0 {
+			return fmt.Errorf("can't parse size change: %s", value)
+		}
+		minSizePercent = p
+		return nil
+	}
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	minSizeBytes = n
+	return nil
+}
+
+func rememberSize(name string) {
+	if stat, err := os.Stat(name); err == nil && stat.Mode().IsRegular() {
+		sizes.Lock()
+		sizes.m[name] = stat.Size()
+		sizes.Unlock()
+	}
+}
+
+// sizeChangedEnough reports whether name's size changed by more than
+// -min-size-change since its last change that was passed on. Small writes
+// add up until they're worth a run.
+func sizeChangedEnough(name string) bool {
+	stat, err := os.Stat(name)
+	if err != nil || !stat.Mode().IsRegular() {
+		return true
+	}
+	size := stat.Size()
+	sizes.Lock()
+	defer sizes.Unlock()
+	last, ok := sizes.m[name]
+	if !ok {
+		sizes.m[name] = size
+		return true
+	}
+	diff := size - last
+	if diff < 0 {
+		diff = -diff
+	}
+	threshold := float64(minSizeBytes)
+	if minSizePercent > 0 {
+		threshold = float64(last) * minSizePercent / 100
+	}
+	if float64(diff) <= threshold {
+		return false
+	}
+	sizes.m[name] = size
+	return true
+}
+
+// fileID identifies a file independently of the path it's reached by.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// inodes maps the files matched so far to the pattern they matched, for
+// -inodes.
+var inodes = struct {
+	sync.Mutex
+	m map[fileID]string
+}{m: make(map[fileID]string)}
+
+func rememberInode(pattern string, name string) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	if id, ok := getFileID(stat); ok && stat.Mode().IsRegular() {
+		inodes.Lock()
+		inodes.m[id] = pattern
+		inodes.Unlock()
+	}
+}
+
+// matchesInode reports whether name is a file that matched pattern before
+// under another path, like the same file seen through a bind mount.
+func matchesInode(pattern string, name string) bool {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	id, ok := getFileID(stat)
+	if !ok {
+		return false
+	}
+	inodes.Lock()
+	defer inodes.Unlock()
+	return inodes.m[id] == pattern
+}
+
+// commandDir is -cwd made absolute, empty to run commands where filewatch
+// runs.
+var commandDir string
+
+// outputPatterns are the -output patterns, made absolute.
+var outputPatterns []string
+
+// recurseRoots are the -recurse-under directories, made absolute.
+var recurseRoots []string
+
+// mayRecurseInto reports whether a new directory may be added to the watch.
+func mayRecurseInto(dir string) bool {
+	if *depth >= 0 && !shallowEnough(dir) {
+		if *verbose {
+			log.Printf("not watching new directory below -depth %d: %s", *depth, dir)
+		}
+		return false
+	}
+	if len(recurseRoots) == 0 {
+		return true
+	}
+	for _, root := range recurseRoots {
+		if isUnder(dir, root) {
+			return true
+		}
+	}
+	if *verbose {
+		log.Printf("not watching new directory outside -recurse-under: %s", dir)
+	}
+	return false
+}
+
+// depthRoots are the directories -depth counts levels from: where the
+// wildcards of each pattern start.
+var depthRoots []string
+
+// shallowEnough reports whether dir is no more than -depth levels below the
+// root of a pattern it falls under. Directories outside all of them, like the
+// parents of literal paths, aren't limited.
+func shallowEnough(dir string) bool {
+	under := false
+	for _, root := range depthRoots {
+		if !isUnder(dir, root) {
+			continue
+		}
+		under = true
+		rel, _ := filepath.Rel(root, dir)
+		levels := 0
+		if rel != "." {
+			levels = len(strings.Split(rel, string(filepath.Separator)))
+		}
+		if levels <= *depth {
+			return true
+		}
+	}
+	return !under
+}
+
+// withinDepth drops the directories below -depth from files, and the files
+// in them.
+func withinDepth(files []string) []string {
+	kept := make([]string, 0, len(files))
+	for _, f := range files {
+		dir := f
+		if stat, err := os.Stat(f); err == nil && !stat.IsDir() {
+			dir = filepath.Dir(f)
+		}
+		if shallowEnough(dir) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// rootDir is the -root boundary, events for paths outside it are dropped.
+var rootDir string
+
+// patternRoot is the default -root: the deepest directory holding both the
+// base directory and everything patterns can match. Regular expressions and
+// file name patterns match below the base directory only.
+func patternRoot(patterns []string) string {
+	root := baseDir
+	for _, pattern := range patterns {
+		if *useRegex || isBasePattern(pattern) {
+			continue
+		}
+		if i := strings.IndexAny(pattern, "*?[{"); i >= 0 && !*literal {
+			pattern = pattern[:i] + "x"
+		}
+		dir := filepath.Dir(pattern)
+		for !isUnder(dir, root) {
+			root = filepath.Dir(root)
+		}
+	}
+	return root
+}
+
+// setRoot sets rootDir from -root, or from patterns without it.
+func setRoot(patterns []string) {
+	if *root == "" {
+		rootDir = patternRoot(patterns)
+		return
+	}
+	rootDir = os.ExpandEnv(*root)
+	if !filepath.IsAbs(rootDir) {
+		rootDir = filepath.Join(baseDir, rootDir)
+	}
+	rootDir = filepath.Clean(rootDir)
+}
+
+// isUnder reports whether name is dir or somewhere below it.
+func isUnder(name string, dir string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// renameWindow is how soon after a Rename a Create has to follow to be taken
+// for the other half of a move.
+const renameWindow = 100 * time.Millisecond
+
+// matchesAny reports whether name matches one of patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		ok, err := matchPattern(pattern, name)
+		if err != nil {
+			fatalf("can't match name: %s", err)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forward passes event on without blocking, fsnotify would stop delivering
+// events to the watcher goroutine while it waits.
+func forward(events chan<- fsnotify.Event, event fsnotify.Event) {
+	select {
+	case events <- event:
+	default:
+		log.Printf("event buffer is full, dropping event: %s", event)
+	}
+}
+
+// coalesceWrites merges the writes and chmods to a file arriving within
+// window of each other into a single event, like the handful of writes an
+// editor makes for one save. Any other event first sends on what's pending,
+// so the order of creates, removes and renames is kept.
+func coalesceWrites(raw <-chan fsnotify.Event, window time.Duration) <-chan fsnotify.Event {
+	out := make(chan fsnotify.Event, *eventBuffer)
+	goBackground(func() {
+		defer close(out)
+		pending := make([]fsnotify.Event, 0)
+		index := make(map[string]int)
+		var flush <-chan time.Time
+		send := func() {
+			for _, event := range pending {
+				out <- event
+			}
+			pending = pending[:0]
+			index = make(map[string]int)
+			flush = nil
+		}
+		for {
+			select {
+			case event, ok := <-raw:
+				if !ok {
+					send()
+					return
+				}
+				if event.Op&^(fsnotify.Write|fsnotify.Chmod) != 0 {
+					send()
+					out <- event
+					continue
+				}
+				if i, ok := index[event.Name]; ok {
+					pending[i].Op |= event.Op
+					continue
+				}
+				index[event.Name] = len(pending)
+				pending = append(pending, event)
+				if flush == nil {
+					flush = clk.After(window)
+				}
+			case <-flush:
+				send()
+			}
+		}
+	})
+	return out
+}
+
+// stabilizing holds the files forwardWhenStable is waiting on.
+var stabilizing = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// forwardWhenStable passes event on once the size of name has stayed the same
+// for -stable-time, so a file that is still being written isn't processed
+// half done. Events for a file already being waited on are dropped, the
+// wait covers them. Nothing is passed on if the file goes away meanwhile.
+func forwardWhenStable(events chan<- fsnotify.Event, event fsnotify.Event, name string) {
+	stabilizing.Lock()
+	waiting := stabilizing.m[name]
+	stabilizing.m[name] = true
+	stabilizing.Unlock()
+	if waiting {
+		return
+	}
+	defer func() {
+		stabilizing.Lock()
+		delete(stabilizing.m, name)
+		stabilizing.Unlock()
+	}()
+
+	interval := *stableTime / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	size := int64(-1)
+	since := clk.Now()
+	for {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return
+		}
+		if stat.Size() != size {
+			size, since = stat.Size(), clk.Now()
+		} else if clk.Now().Sub(since) >= *stableTime {
+			forward(events, event)
+			return
+		}
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-clk.After(interval):
+		}
+	}
+}
+
+// watchForChanges filters raw events, normally the fsnotify watcher's, down to
+// the ones matching patterns and passes them on. New directories matching
+// dirPatterns are added to the watch on the way, and all three are reloaded
+// on a receive from reloads. The returned ready channel is closed once events
+// are being read.
+func watchForChanges(raw <-chan fsnotify.Event, errs <-chan error, reloads <-chan struct{}, patterns []string, dirPatterns []string, excludes []string) (chan fsnotify.Event, <-chan struct{}) {
+	events := make(chan fsnotify.Event, *eventBuffer)
+	ready := make(chan struct{})
+	if *coalesceWindow > 0 {
+		raw = coalesceWrites(raw, *coalesceWindow)
+	}
+
+	// Editors often emit a couple of identical writes per save, and a file
+	// watched along with its directory reports each event twice.
+	var last fsnotify.Event
+	var lastAt time.Time
+	// renamedFrom is the name of the last file renamed, for -rename-aware.
+	var renamedFrom string
+	var renamedAt time.Time
+
+	// accept passes on an event that matched, unless it's one of the kinds
+	// filtered out after matching.
+	accept := func(event fsnotify.Event, absName string) {
+		if event.Op == fsnotify.Chmod {
+			return
+		}
+		now := clk.Now()
+		duplicate := event.Name == last.Name && event.Op == last.Op && now.Sub(lastAt) < *buffer
+		last, lastAt = event, now
+		if duplicate {
+			return
+		}
+		if *gitTracked && !isTracked(absName) {
+			if *verbose {
+				log.Printf("not tracked by git: %s", absName)
+			}
+			return
+		}
+		// With -large-files trigger a large file skips the checks below
+		// that look at the file.
+		large := maxFileBytes > 0 && isLargeFile(absName)
+		if large && *largeFiles == "ignore" {
+			if *verbose {
+				log.Printf("ignoring large file: %s", absName)
+			}
+			return
+		}
+		if *minSizeChange != "" && !large && event.Op&fsnotify.Write != 0 && !sizeChangedEnough(absName) {
+			if *verbose {
+				log.Printf("size barely changed: %s", absName)
+			}
+			return
+		}
+		if *verbose {
+			log.Printf("event: %+v", event.Name)
+		}
+		stats.Lock()
+		stats.lastEvent = now
+		stats.events++
+		running := stats.running
+		stats.Unlock()
+		// Whatever happens during a run is most likely the run's own
+		// doing.
+		if *ignoreDuringRun && running > 0 {
+			if *verbose {
+				log.Printf("ignoring event during run: %s", event.Name)
+			}
+			return
+		}
+		if removals != nil && event.Op&fsnotify.Remove == fsnotify.Remove {
+			removals.add(event)
+			return
+		}
+		dest := events
+		if r := routeFor(absName); r != nil {
+			dest = r.events
+		}
+		if *stableTime > 0 && !large && event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+			goBackground(func() { forwardWhenStable(dest, event, absName) })
+			return
+		}
+		forward(dest, event)
+	}
+
+	reload := func() {
+		restartPatterns.Lock()
+		restart := restartPatterns.patterns
+		restartPatterns.Unlock()
+		ws := reloadWatchSet(watchSet{patterns: patterns, dirPatterns: dirPatterns, excludes: excludes, restart: restart})
+		patterns, dirPatterns, excludes = ws.patterns, ws.dirPatterns, ws.excludes
+		setRestartPatterns(ws.restart)
+		// Files added to or removed from git since are picked up along
+		// with the patterns.
+		if *gitTracked {
+			if err := loadTracked(); err != nil {
+				log.Printf("%s, keeping the files tracked before", err)
+			}
+		}
+	}
+	ignoreFile := filepath.Join(baseDir, ignoreFileName)
+	rs := routes
+
+	goBackground(func() {
+		// Also when a fatal error ends the goroutine, the strategy
+		// reading events would wait forever otherwise.
+		defer func() {
+			close(events)
+			for _, r := range rs {
+				close(r.events)
+			}
+		}()
+		close(ready)
+		for {
+			select {
+			case event, ok := <-raw:
+				if !ok {
+					return
+				}
+				absName, err := filepath.Abs(event.Name)
+				if err != nil {
+					fatalf("can't get abs path for event: %s %s", event.Name, err)
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Rename) != 0 && relinked(absName) {
+					rewatch(absName, watchSet{dirPatterns: dirPatterns, excludes: excludes})
+					forward(events, fsnotify.Event{Name: absName, Op: fsnotify.Write})
+					continue
+				}
+				if isGitHead(absName) {
+					if event.Op != fsnotify.Chmod {
+						forward(events, event)
+					}
+					continue
+				}
+				// The file is still matched like any other below, a
+				// command may depend on it.
+				if *watchIgnoreFile && absName == ignoreFile && event.Op != fsnotify.Chmod {
+					log.Printf("%s changed, reloading patterns", ignoreFileName)
+					reload()
+				}
+				// Symlinks and mounts can lead the watch to places the
+				// patterns were never meant to cover.
+				if !isUnder(absName, rootDir) {
+					if *verbose {
+						log.Printf("outside -root %s: %s", rootDir, absName)
+					}
+					continue
+				}
+				isDir := false
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					isDir = forgetWatch(absName)
+				}
+				if isExcluded(excludes, absName) {
+					if *verbose {
+						log.Printf("excluded: %s", absName)
+					}
+					continue
+				}
+				// The command's own writes never trigger it, however
+				// late they come.
+				if isExcluded(outputPatterns, absName) {
+					if *verbosity >= 2 {
+						log.Printf("command output: %s", absName)
+					}
+					continue
+				}
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					// Short-lived files, like the temporaries of an
+					// extracting archive, may be gone already.
+					stat, err := os.Stat(absName)
+					if err != nil && *verbose {
+						log.Printf("can't get stat for file: %s, %s", absName, err)
+					}
+					isDir = err == nil && stat.IsDir()
+					if isDir && mayRecurseInto(absName) {
+						for _, pattern := range dirPatterns {
+							ok, err := matchPattern(pattern, absName)
+							if err != nil {
+								fatalf("can't match name: %s", err)
+							}
+							if ok {
+								addFilesToWatch([]string{absName})
+								break
+							}
+						}
+					}
+				}
+				// A move shows up as a Rename of the old name followed by a
+				// Create of the new one. With -rename-aware a file moved
+				// away from where the patterns look is still reported,
+				// under its new name.
+				if *renameAware && event.Op&fsnotify.Rename != 0 {
+					renamedFrom, renamedAt = absName, clk.Now()
+				} else if *renameAware && event.Op&fsnotify.Create != 0 && renamedFrom != "" {
+					from := renamedFrom
+					renamedFrom = ""
+					if clk.Now().Sub(renamedAt) < renameWindow && matchesAny(patterns, from) && !matchesAny(patterns, absName) {
+						if *verbose {
+							log.Printf("moved: %s -> %s", from, absName)
+						}
+						accept(event, absName)
+						continue
+					}
+				}
+				matched := false
+				for _, pattern := range patterns {
+					ok, err := matchPattern(pattern, absName)
+					if err != nil {
+						fatalf("can't match name: %s", err)
+					}
+					if *trackInodes {
+						if ok {
+							rememberInode(pattern, absName)
+						} else {
+							ok = matchesInode(pattern, absName)
+						}
+					}
+					// With many patterns logging every attempt drowns out
+					// everything else.
+					if *verbosity >= 2 || (*verbose && ok) {
+						log.Printf("will match: %s %s res: %v", pattern, absName, ok)
+					}
+					if ok {
+						matched = true
+						accept(event, absName)
+						if *firstMatchOnly {
+							break
+						}
+					}
+				}
+				// A directory appearing or going away where the patterns
+				// look counts as a change of its own with -match-dirs.
+				if !matched && isDir && *matchDirs && event.Op != fsnotify.Write && event.Op != fsnotify.Chmod {
+					for _, pattern := range dirPatterns {
+						if ok, _ := matchPattern(pattern, absName); ok {
+							accept(event, absName)
+							break
+						}
+					}
+				}
+			case <-reloads:
+				reload()
+			case err, ok := <-errs:
+				// Closed along with the events when filewatch exits.
+				if !ok {
+					errs = nil
+					continue
+				}
+				// The watch can't be trusted anymore, stop the command and
+				// run the exit hooks like on a signal.
+				if err != nil {
+					emitJSON(jsonRecord{Type: "watch-error", Error: err.Error()})
+					log.Printf("watch error: %s", err)
+				} else {
+					log.Printf("unexpected watch error")
+				}
+				exit(*watchErrorCode)
+			}
+		}
+	})
+
+	return events, ready
+}
+
+// reloadOnSignal asks watchForChanges to reload the watch set on SIGHUP.
+func reloadOnSignal(ctx context.Context, reloads chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	if !reloadSignals(signals) {
+		return
+	}
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+		log.Printf("got SIGHUP, reloading patterns")
+		select {
+		case reloads <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadWatchSet loads the watch set again and brings the watches in line
+// with it, keeping current if that fails. It runs where events are matched,
+// so no event sees half of each.
+func reloadWatchSet(current watchSet) watchSet {
+	roots := depthRoots
+	ws, err := loadWatchSet()
+	var files []string
+	if err == nil {
+		files, err = expandWatchSet(ws)
+	}
+	if err != nil {
+		depthRoots = roots
+		log.Printf("can't reload, keeping the current patterns: %s", err)
+		return current
+	}
+	setRoot(ws.patterns)
+	rememberState(ws, files)
+
+	// Files are watched along with their directories.
+	wanted := make(map[string]bool)
+	for _, f := range files {
+		wanted[filepath.Clean(f)] = true
+		wanted[filepath.Dir(filepath.Clean(f))] = true
+	}
+	if gitHead != "" {
+		wanted[filepath.Dir(gitHead)] = true
+	}
+	if *watchIgnoreFile {
+		wanted[baseDir] = true
+	}
+	stats.Lock()
+	before := make(map[string]bool, len(stats.watched))
+	stale := make([]string, 0)
+	for w := range stats.watched {
+		before[w] = true
+		if !wanted[w] {
+			stale = append(stale, w)
+		}
+	}
+	stats.Unlock()
+	for _, w := range stale {
+		watch.Remove(w)
+		forgetWatch(w)
+	}
+	if err := addFilesToWatch(files); err != nil {
+		log.Printf("can't watch: %s", err)
+	}
+	added := 0
+	stats.Lock()
+	for w := range stats.watched {
+		if !before[w] {
+			added++
+		}
+	}
+	stats.Unlock()
+
+	log.Printf("reloaded: patterns %+v, excludes %+v, %d watches added, %d removed", ws.patterns, ws.excludes, added, len(stale))
+	return ws
+}
+
+func logHeartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		stats.Lock()
+		watched, lastEvent := len(stats.watched), stats.lastEvent
+		stats.Unlock()
+
+		if lastEvent.IsZero() {
+			log.Printf("still watching %d files, no events yet", watched)
+		} else {
+			log.Printf("still watching %d files, last event at %s", watched, lastEvent.Format(time.RFC3339))
+		}
+	}
+}
+
+// lastDump is when logState was last called and how many events there had
+// been by then, for the event rate.
+var lastDump = struct {
+	at     time.Time
+	events int
+}{at: time.Now()}
+
+// logState logs what's being watched and how it's going, on request from a
+// signal, see dumpSignals.
+func logState() {
+	stats.Lock()
+	watched := make([]string, 0, len(stats.watched))
+	for name := range stats.watched {
+		watched = append(watched, name)
+	}
+	events, running, failed := stats.events, stats.running, stats.lastRunFailed
+	stats.Unlock()
+
+	dirs := 0
+	for _, name := range watched {
+		if stat, err := os.Stat(name); err == nil && stat.IsDir() {
+			dirs++
+		}
+	}
+
+	now := time.Now()
+	rate := float64(events-lastDump.events) / now.Sub(lastDump.at).Minutes()
+	lastDump.at, lastDump.events = now, events
+
+	status := "succeeded"
+	switch {
+	case running > 0:
+		status = "running"
+	case atomic.LoadInt64(&lastRunID) == 0:
+		status = "not run yet"
+	case failed:
+		status = "failed"
+	}
+	log.Printf("state: %d watches, %d of them directories, %.1f events per minute since the last dump, command %s",
+		len(watched), dirs, rate, status)
+}
+
+func logStateOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	if !dumpSignals(signals) {
+		return
+	}
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			logState()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notifySeparately is whether -notify-t is set, and changes are reported on
+// their own schedule rather than along with each run.
+var notifySeparately bool
+
+// notify reports a change to -print-changed, -socket and -json.
+func notify(t trigger) {
+	if *printChanged {
+		for _, f := range t.files {
+			fmt.Fprintln(stdout, f)
+		}
+	}
+	if sock != nil {
+		sock.send(t)
+	}
+	emitJSON(jsonRecord{Type: "change", Files: t.files})
+	if *webhook != "" {
+		goBackground(func() { postWebhook(t) })
+	}
+}
+
+// notifyChanges debounces events by -notify-t alone and reports them, so
+// observers hear about a change before the command's debounce is over.
+func notifyChanges(events <-chan fsnotify.Event) {
+	for {
+		event, ok := <-events
+		if !ok {
+			return
+		}
+		changed := newChangeSet(event)
+	LOOP:
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					break LOOP
+				}
+				changed.add(event)
+			case <-clk.After(*notifyInterval):
+				break LOOP
+			}
+		}
+		notify(newTrigger(changed.events))
+	}
+}
+
+// tee passes every event on to two channels, one for each consumer.
+func tee(events <-chan fsnotify.Event) (chan fsnotify.Event, chan fsnotify.Event) {
+	a := make(chan fsnotify.Event, *eventBuffer)
+	b := make(chan fsnotify.Event, *eventBuffer)
+	goBackground(func() {
+		for event := range events {
+			forward(a, event)
+			forward(b, event)
+		}
+		close(a)
+		close(b)
+	})
+	return a, b
+}
+
+// trigger is what a run was started for.
+type trigger struct {
+	// files are the changed files without duplicates, the most recently
+	// changed one last. It's empty for the -initial run.
+	files []string
+	// run identifies the run in logs and to the command, see nextRunID.
+	run int64
+	// time is when the most recent change came in, zero for the -initial
+	// run.
+	time time.Time
+}
+
+// lastRunID is the id of the latest run, ids count up from 1.
+var lastRunID int64
+
+func nextRunID() int64 {
+	return atomic.AddInt64(&lastRunID, 1)
+}
+
+func newTrigger(changed []fsnotify.Event) trigger {
+	var t trigger
+	seen := make(map[string]bool)
+	for i := len(changed) - 1; i >= 0; i-- {
+		name := changed[i].Name
+		if seen[name] || isGitHead(name) {
+			continue
+		}
+		seen[name] = true
+		t.files = append([]string{name}, t.files...)
+	}
+	stats.Lock()
+	t.time = stats.lastEvent
+	stats.Unlock()
+	if dropped := atomic.SwapInt64(&droppedChanges, 0); dropped > 0 {
+		log.Printf("more than %d files changed, passing on the %d changed first", *maxChanges, len(t.files))
+	}
+	return t
+}
+
+// file returns the most recently changed file.
+func (t trigger) file() string {
+	if len(t.files) == 0 {
+		return ""
+	}
+	return t.files[len(t.files)-1]
+}
+
+// expandSetEnv expands the environment variables in s that are set, as $NAME
+// or ${NAME}, and leaves everything else exactly as written for the shell, so
+// a loop variable like $f or awk's $2 in a command survives.
+func expandSetEnv(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		name, end := "", i+1
+		if s[i+1] == '{' {
+			if j := strings.IndexByte(s[i+2:], '}'); j >= 0 {
+				name, end = s[i+2:i+2+j], i+3+j
+			}
+		} else {
+			for end < len(s) && isNameByte(s[end]) {
+				end++
+			}
+			name = s[i+1 : end]
+		}
+		if value, ok := os.LookupEnv(name); ok && name != "" {
+			b.WriteString(value)
+			i = end - 1
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// expandCommand replaces {file}, {files} and {dir} in command with the shell
+// quoted last changed file, all changed files and the last file's directory.
+func expandCommand(command string, t trigger) string {
+	if t.file() == "" {
+		return command
+	}
+	quoted := make([]string, len(t.files))
+	for i, f := range t.files {
+		quoted[i] = shellQuote(remotePath(f))
+	}
+	return strings.NewReplacer(
+		"{file}", shellQuote(remotePath(t.file())),
+		"{files}", strings.Join(quoted, " "),
+		"{dir}", shellQuote(remotePath(filepath.Dir(t.file()))),
+		"{time}", shellQuote(t.time.Format(time.RFC3339)),
+	).Replace(command)
+}
+
+// remotePath maps a local path below -base to the same path below
+// -remote-dir for a command run with -ssh.
+func remotePath(name string) string {
+	if *sshHost == "" || *remoteDir == "" {
+		return name
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil || !isUnder(abs, baseDir) {
+		return name
+	}
+	rel, _ := filepath.Rel(baseDir, abs)
+	return path.Join(*remoteDir, filepath.ToSlash(rel))
+}
+
+// runEnv is the environment a command gets for t on top of filewatch's own.
+func runEnv(t trigger) []string {
+	env := []string{fmt.Sprintf("FILEWATCH_RUN_ID=%d", t.run)}
+	if !t.time.IsZero() {
+		env = append(env, "FILEWATCH_TIME="+t.time.Format(time.RFC3339))
+	}
+	return env
+}
+
+// shellCommand returns the command line that runs command, through the local
+// shell or, with -ssh, the remote one. ssh doesn't pass the environment on,
+// so env is exported in front of the remote command.
+func shellCommand(command string, env []string) []string {
+	if *sshHost == "" {
+		return []string{"sh", "-c", command}
+	}
+	if *remoteDir != "" {
+		command = "cd " + shellQuote(*remoteDir) + " && " + command
+	}
+	if len(env) > 0 {
+		vars := make([]string, len(env))
+		for i, v := range env {
+			kv := strings.SplitN(v, "=", 2)
+			vars[i] = kv[0] + "=" + shellQuote(kv[1])
+		}
+		command = "export " + strings.Join(vars, " ") + "; " + command
+	}
+	return []string{"ssh", "-T", *sshHost, command}
+}
+
+// runCommand runs command for t and waits for it, unless detached, which
+// -detach has the user's commands be. Hooks and -only-if always run attached,
+// what follows depends on them being done.
+func runCommand(ctx context.Context, command string, prefix string, t trigger, detached bool) error {
+	command = expandCommand(command, t)
+	if t.run == 0 {
+		t.run = nextRunID()
+	}
+	env := runEnv(t)
+	args := shellCommand(command, env)
+	if *printCommand {
+		log.Printf("%s> %s %s", prefix, strings.Join(args[:len(args)-1], " "), shellQuote(command))
+	}
+
+	// Each line of output pushes the idle timeout back, a command that stays
+	// silent for longer is taken to be hung.
+	active := func() {}
+	if *idleTimeout > 0 && !*inheritIO && !*noCommandOutput {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		idle := time.AfterFunc(*idleTimeout, func() {
+			log.Printf("%sno output for %s, killing: %s", prefix, *idleTimeout, command)
+			cancel()
+		})
+		defer idle.Stop()
+		active = func() { idle.Reset(*idleTimeout) }
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if detached {
+		// Not tied to ctx, so neither a change nor exiting kills it.
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Dir = commandDir
+	cmd.Env = append(os.Environ(), env...)
+	if detached {
+		return startDetached(cmd, command, prefix)
+	}
+
+	out := newOutput(prefix, active)
+	if *logFile != "" {
+		f, err := openRunLog(t)
+		if err != nil {
+			log.Printf("%s%s", prefix, err)
+		} else {
+			defer f.Close()
+			out.file = f
+		}
+	}
+
+	started := time.Now()
+	emitJSON(jsonRecord{Type: "start", Run: t.run, Command: command, Files: t.files})
+	err := execute(ctx, cmd, command, t.run, out)
+	code := -1
+	if cmd.ProcessState != nil {
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+		}
+	}
+	emitJSON(jsonRecord{Type: "exit", Run: t.run, Command: command, Code: &code, Duration: time.Since(started).Seconds()})
+	if *summary {
+		log.Printf("%ssummary: run %d exit code %d after %s, triggered by %s", prefix, t.run, code,
+			time.Since(started).Round(time.Millisecond), describeFiles(t.files))
+	}
+	return err
+}
+
+// startDetached starts cmd for -detach and leaves it alone. Its output goes
+// straight to filewatch's, and its exit status is only logged in verbose
+// mode. It gets a process group of its own, so a Ctrl-C meant for filewatch
+// doesn't reach it either.
+func startDetached(cmd *exec.Cmd, command string, prefix string) error {
+	setProcessGroup(cmd)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return startError(command, err)
+	}
+	if *verbose {
+		log.Printf("%sdetached: %s (pid %d)", prefix, command, cmd.Process.Pid)
+	}
+	// It may outlive Run, which doesn't wait for it.
+	verbose := *verbose
+	go func() {
+		err := cmd.Wait()
+		if verbose {
+			log.Printf("%sdetached command exited: %s %v", prefix, command, err)
+		}
+	}()
+	return nil
+}
+
+// describeFiles lists files for a log line, shortening long lists.
+func describeFiles(files []string) string {
+	const max = 5
+	switch {
+	case len(files) == 0:
+		return "initial run"
+	case len(files) > max:
+		return fmt.Sprintf("%s and %d more", strings.Join(files[:max], ", "), len(files)-max)
+	}
+	return strings.Join(files, ", ")
+}
+
+// startError reports a command that couldn't be started. That's only fatal
+// with -strict, so a broken command can be fixed without restarting
+// filewatch. A run cancelled before it started isn't an error worth a word.
+func startError(command string, err error) error {
+	if err == context.Canceled {
+		return err
+	}
+	if *strict {
+		// Returns only while exiting already.
+		fatalf("can't start command: %s %s", command, err)
+		return err
+	}
+	log.Printf("can't start command: %s %s", command, err)
+	return err
+}
+
+// startCommand starts cmd in a process group of its own and kills the whole
+// group once ctx is cancelled. Killing just the shell would leave its
+// children, like the server "go run" builds, running and holding on to the
+// output pipes. exited has to be called once cmd is done.
+func startCommand(ctx context.Context, cmd *exec.Cmd) (exited func(), err error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	processes.Lock()
+	processes.m[cmd.Process] = true
+	processes.Unlock()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd.Process)
+		case <-done:
+		}
+	}()
+	return func() {
+		processes.Lock()
+		delete(processes.m, cmd.Process)
+		processes.Unlock()
+		close(done)
+	}, nil
+}
+
+// processes are the commands started by startCommand that haven't exited yet.
+var processes = struct {
+	sync.Mutex
+	m map[*os.Process]bool
+}{m: make(map[*os.Process]bool)}
+
+// killRunning kills every running command's process group right away, since
+// exiting doesn't leave time for the goroutines watching their contexts.
+func killRunning() {
+	processes.Lock()
+	defer processes.Unlock()
+	for p := range processes.m {
+		killProcessGroup(p)
+	}
+}
+
+// execute starts cmd, passes its output on to out and waits for it to exit.
+// run is the id of the run it belongs to, for -json.
+func execute(ctx context.Context, cmd *exec.Cmd, command string, run int64, out *output) error {
+	prefix := out.prefix
+	if *inheritIO || *noCommandOutput {
+		// Leaving them nil connects both to the null device.
+		if !*noCommandOutput {
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			if out.file != nil {
+				cmd.Stdout = io.MultiWriter(stdout, out.file)
+				cmd.Stderr = io.MultiWriter(stderr, out.file)
+			}
+		}
+		exited, err := startCommand(ctx, cmd)
+		if err != nil {
+			return startError(command, err)
+		}
+		defer exited()
+		err = waitCommand(cmd, command, prefix)
+		if *noCommandOutput && cmd.ProcessState != nil && cmd.ProcessState.Success() {
+			log.Printf("%s%s", prefix, cmd.ProcessState)
+		}
+		return err
+	}
+
+	if *mergeOutput {
+		return executeMerged(ctx, cmd, command, run, out)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fatalf("can't get stdout for command: %s %s", command, err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		fatalf("can't get stderr for command: %s %s", command, err)
+	}
+
+	exited, err := startCommand(ctx, cmd)
+	if err != nil {
+		return startError(command, err)
+	}
+	defer exited()
+
+	// Both pipes have to be drained before Wait closes them, or the last
+	// lines, in particular one without a trailing newline, are lost.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		readLines(stderr, func(line string) {
+			line = rewriteOutput(line)
+			emitJSON(jsonRecord{Type: "output", Run: run, Command: command, Stream: "stderr", Line: line})
+			out.line("[STDERR] " + line)
+		})
+	}()
+	readLines(stdout, func(line string) {
+		line = rewriteOutput(line)
+		emitJSON(jsonRecord{Type: "output", Run: run, Command: command, Stream: "stdout", Line: line})
+		out.line(line)
+	})
+	wg.Wait()
+
+	out.flush(command)
+	return waitCommand(cmd, command, prefix)
+}
+
+// executeMerged runs cmd with stdout and stderr going into a single pipe, so
+// their lines are logged in the order the command wrote them. Which stream
+// a line came from is lost on the way.
+func executeMerged(ctx context.Context, cmd *exec.Cmd, command string, run int64, out *output) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fatalf("can't get a pipe for command: %s %s", command, err)
+	}
+	defer r.Close()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	exited, err := startCommand(ctx, cmd)
+	// Only the command writes to the pipe now, reading ends when it's done.
+	w.Close()
+	if err != nil {
+		return startError(command, err)
+	}
+	defer exited()
+
+	readLines(r, func(line string) {
+		line = rewriteOutput(line)
+		emitJSON(jsonRecord{Type: "output", Run: run, Command: command, Stream: "merged", Line: line})
+		out.line(line)
+	})
+
+	out.flush(command)
+	return waitCommand(cmd, command, out.prefix)
+}
+
+// output passes a command's output lines on to the log, straight away or,
+// with -buffer-output, all at once when the command is done.
+type output struct {
+	sync.Mutex
+	prefix string
+	lines  []string
+	active func()
+	// file gets a copy of every line with -log-file, nil otherwise.
+	file io.Writer
+}
+
+func newOutput(prefix string, active func()) *output {
+	return &output{prefix: prefix, active: active}
+}
+
+func (o *output) line(line string) {
+	o.active()
+	if o.file != nil {
+		o.Lock()
+		fmt.Fprintf(o.file, "%s%s\n", o.prefix, line)
+		o.Unlock()
+	}
+	if !*bufferOutput && !*collapseOutput {
+		log.Printf("%s%s", o.prefix, line)
+		return
+	}
+	o.Lock()
+	o.lines = append(o.lines, line)
+	o.Unlock()
+}
+
+// flush logs the buffered lines, under a header with -buffer-output, in a
+// single write so they can't be interleaved with the output of other
+// commands. With -collapse-output the lines are only logged if they differ
+// from what the command printed last time.
+func (o *output) flush(command string) {
+	if !*bufferOutput && !*collapseOutput {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	lines := make([]string, 0, len(o.lines)+1)
+	if *bufferOutput {
+		lines = append(lines, fmt.Sprintf("%s--- %s ---", o.prefix, command))
+	}
+	for _, line := range o.lines {
+		lines = append(lines, o.prefix+line)
+	}
+	o.lines = nil
+
+	if *collapseOutput {
+		text := strings.Join(lines, "\n")
+		previousOutput.Lock()
+		same := previousOutput.m[o.prefix+command] == text
+		previousOutput.m[o.prefix+command] = text
+		previousOutput.Unlock()
+		if same {
+			log.Printf("%s(same as previous run)", o.prefix)
+			return
+		}
+	}
+	if *bufferOutput {
+		log.Print(strings.Join(lines, "\n"))
+		return
+	}
+	for _, line := range lines {
+		log.Print(line)
+	}
+}
+
+// previousOutput is what each command printed on its last run, for
+// -collapse-output.
+var previousOutput = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// runLogName expands the -log-file template for a command of a run, as in
+// logs/run-{runid}.log. {time} is the time the command starts, to the second.
+func runLogName(t trigger) string {
+	return strings.NewReplacer(
+		"{runid}", strconv.FormatInt(t.run, 10),
+		"{time}", time.Now().Format("20060102-150405"),
+	).Replace(*logFile)
+}
+
+// openRunLog opens the -log-file for a command of a run for appending. With
+// {runid} all commands and retries of a run end up in the same file, with
+// {time} those starting in another second get one of their own. Creating a
+// new one prunes the oldest ones beyond -log-keep.
+func openRunLog(t trigger) (*os.File, error) {
+	name := runLogName(t)
+	_, err := os.Stat(name)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, fmt.Errorf("can't create log directory: %s %s", name, err)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open log file: %s %s", name, err)
+	}
+	if created && *logKeep > 0 {
+		pruneRunLogs()
+	}
+	return f, nil
+}
+
+// pruneRunLogs removes all but the -log-keep newest files the -log-file
+// template can expand to.
+func pruneRunLogs() {
+	pattern := strings.NewReplacer("{runid}", "*", "{time}", "*").Replace(*logFile)
+	if pattern == *logFile {
+		return
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil || len(names) <= *logKeep {
+		return
+	}
+	modTimes := make(map[string]time.Time)
+	for _, name := range names {
+		if stat, err := os.Stat(name); err == nil {
+			modTimes[name] = stat.ModTime()
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return modTimes[names[i]].After(modTimes[names[j]]) })
+	for _, name := range names[*logKeep:] {
+		if err := os.Remove(name); err != nil {
+			log.Printf("can't remove old log file: %s %s", name, err)
+		}
+	}
+}
+
+// shellQuote quotes s for pasting into a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// readLines hands everything read from r to emit line by line, including a
+// final line that isn't terminated by a newline, until r is closed.
+func readLines(r io.Reader, emit func(line string)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		emit(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("can't read command output: %s", err)
+		// Keep the pipe flowing so the command doesn't block on a full one.
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// successCodeSet is parsed from -success-codes in main.
+var successCodeSet = map[int]bool{0: true}
+
+func parseSuccessCodes(value string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, c := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("can't parse exit code: %s %s", c, err)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// exitCode returns the exit code of a finished command, or -1 if it was
+// killed by a signal or couldn't be waited for.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+func waitCommand(cmd *exec.Cmd, command string, prefix string) error {
+	err := cmd.Wait()
+	if e, ok := err.(*exec.ExitError); ok {
+		log.Printf("%s%s", prefix, e.ProcessState)
+	} else if err != nil {
+		log.Printf("%scan't wait for process: %s %s", prefix, command, err)
+	}
+	return err
+}
+
+// succeeded reports whether a command that returned err counts as a success
+// according to -success-codes.
+func succeeded(err error) bool {
+	return successCodeSet[exitCode(err)]
+}
+
+// runCommands runs every configured command, one after another or all at
+// once with -parallel, and reports whether all of them succeeded.
+func runCommands(ctx context.Context, t trigger) bool {
+	if atomic.LoadInt32(&stopping) == 1 {
+		return true
+	}
+	stats.Lock()
+	stats.running++
+	stats.Unlock()
+	defer func() {
+		stats.Lock()
+		stats.running--
+		stats.Unlock()
+	}()
+
+	if *lockFile != "" {
+		unlock, ok := acquireLock(ctx)
+		if !ok {
+			return true
+		}
+		defer unlock()
+	}
+
+	if *healthURL != "" {
+		healthCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		goBackground(func() { checkHealth(healthCtx, t.run) })
+	}
+
+	if !*parallel {
+		for _, c := range commands {
+			if err := runCommand(ctx, c, "", t, *detach); !succeeded(err) {
+				if len(commands) > 1 {
+					log.Printf("command failed, skipping the rest: %s", c)
+				}
+				return false
+			}
+		}
+		return true
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(commands))
+	for i, c := range commands {
+		wg.Add(1)
+		go func(i int, c string) {
+			defer wg.Done()
+			errs[i] = runCommand(ctx, c, fmt.Sprintf("[%d] ", i+1), t, *detach)
+		}(i, c)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if !succeeded(err) {
+			failed++
+			log.Printf("[%d] failed: %s", i+1, commands[i])
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d of %d commands failed", failed, len(commands))
+		return false
+	}
+	log.Printf("all %d commands succeeded", len(commands))
+	return true
+}
+
+// lockPoll is how often a busy -lockfile is tried again.
+const lockPoll = 100 * time.Millisecond
+
+// acquireLock takes the -lockfile lock for a run, waiting for other processes
+// holding it unless -lock-skip is set. It reports false if the run should be
+// skipped, because of -lock-skip, a change meanwhile or an error.
+func acquireLock(ctx context.Context) (unlock func(), ok bool) {
+	f, err := os.OpenFile(*lockFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Printf("can't open lock file, skipping run: %s", err)
+		return nil, false
+	}
+	waited := false
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			log.Printf("can't lock, skipping run: %s %s", *lockFile, err)
+			return nil, false
+		}
+		if locked {
+			break
+		}
+		if *lockSkip {
+			f.Close()
+			log.Printf("%s is locked, skipping run", *lockFile)
+			return nil, false
+		}
+		if !waited && *verbose {
+			log.Printf("%s is locked, waiting", *lockFile)
+		}
+		waited = true
+		if !sleepCtx(ctx, lockPoll) {
+			f.Close()
+			return nil, false
+		}
+	}
+	// Closing releases the lock.
+	return func() { f.Close() }, true
+}
+
+// runWithRetries runs the commands until they succeed, retrying at most
+// retries times (forever if negative) or until ctx is cancelled by a change.
+func runWithRetries(ctx context.Context, t trigger, retries int) bool {
+	t.run = nextRunID()
+	if *verbose {
+		log.Printf("run %d: triggered by %s", t.run, describeFiles(t.files))
+	}
+	// The delay gives tools downstream of the change, like a bundler still
+	// writing its output, time to finish. The run is cancelled along with
+	// it if another change comes in meanwhile.
+	if *delay > 0 && len(t.files) > 0 && !sleepCtx(ctx, *delay) {
+		return false
+	}
+	if *onlyIf != "" {
+		err := runCommand(ctx, *onlyIf, "[only-if] ", t, false)
+		if err != nil {
+			if *verbose && ctx.Err() == nil {
+				log.Printf("-only-if failed, not running: %s", err)
+			}
+			return ctx.Err() == nil
+		}
+	}
+	ok := retryCommands(ctx, t, retries)
+	// A run killed for a restart didn't fail on its own.
+	if ctx.Err() == nil {
+		stats.Lock()
+		stats.lastRunFailed = !ok
+		stats.Unlock()
+		ringBell(ok)
+	}
+	return ok
+}
+
+// ringBell writes the terminal bell after a run as -bell asks for. It's left
+// out with -json, where a stray control character is only in the way.
+func ringBell(ok bool) {
+	if *jsonOutput || *bell == "" || (*bell == "failure" && ok) {
+		return
+	}
+	fmt.Fprint(stderr, "\a")
+}
+
+// sleepCtx sleeps for d and reports whether ctx is still alive afterwards.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func retryCommands(ctx context.Context, t trigger, retries int) bool {
+	for attempt := 0; ; attempt++ {
+		if runCommands(ctx, t) {
+			return true
+		}
+		if retries >= 0 && attempt >= retries {
+			return false
+		}
+		if !sleepCtx(ctx, *retryDelay) {
+			return false
+		}
+		log.Printf("retrying, attempt %d", attempt+1)
+	}
+}
+
+// restartPatterns are the -filenames patterns when -reload-filenames is
+// set, the ones that restart the command rather than reload. A reload
+// replaces them while runs are being started.
+var restartPatterns struct {
+	sync.Mutex
+	patterns []string
+}
+
+func setRestartPatterns(patterns []string) {
+	restartPatterns.Lock()
+	restartPatterns.patterns = patterns
+	restartPatterns.Unlock()
+}
+
+// needsReloadOnly reports whether none of the changed files match
+// restartPatterns. A change matching both restarts, which picks up the
+// reloadable files as well.
+func needsReloadOnly(t trigger) bool {
+	restartPatterns.Lock()
+	patterns := restartPatterns.patterns
+	restartPatterns.Unlock()
+	if patterns == nil || len(t.files) == 0 {
+		return false
+	}
+	for _, f := range t.files {
+		for _, pattern := range patterns {
+			if ok, _ := matchPattern(pattern, f); ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// initialRetries is how often a failed initial run is retried. A failing
+// initial run usually means the environment isn't ready yet, e.g. missing
+// dependencies, so retrying may be pointless.
+func initialRetries() int {
+	if *noInitialRetry {
+		return 0
+	}
+	return *retries
+}
+
+// keyLocks serializes runs for the same -serialize-by key.
+var keyLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func keyLock(key string) *sync.Mutex {
+	keyLocks.Lock()
+	defer keyLocks.Unlock()
+	l, ok := keyLocks.m[key]
+	if !ok {
+		l = &sync.Mutex{}
+		keyLocks.m[key] = l
+	}
+	return l
+}
 
-		if err := watch.Add(f); err != nil {
-			return fmt.Errorf("can't add file to watch: %s, %s", f, err)
+// runKeyed splits t by file or directory and runs the commands for each part
+// concurrently. Runs for the same key wait for each other instead of being
+// cancelled, so two runs for one package never overlap.
+func runKeyed(t trigger) {
+	groups := make(map[string]*trigger)
+	for _, f := range t.files {
+		key := f
+		if *serializeBy == "dir" {
+			key = filepath.Dir(f)
 		}
-		if !stat.IsDir() {
-			if err := watch.Add(path.Dir(f)); err != nil {
-				return fmt.Errorf("can't add file to watch: %s, %s", f, err)
-			}
+		g, ok := groups[key]
+		if !ok {
+			g = &trigger{time: t.time}
+			groups[key] = g
 		}
+		g.files = append(g.files, f)
+	}
+
+	for key, g := range groups {
+		key, g := key, *g
+		goBackground(func() {
+			l := keyLock(key)
+			l.Lock()
+			defer l.Unlock()
+			if lim := limitFor(g.files); lim != nil {
+				if *verbose && len(lim.slots) == lim.max {
+					log.Printf("waiting, %d runs for %s already going: %s", lim.max, lim.pattern, key)
+				}
+				lim.slots <- struct{}{}
+				defer func() { <-lim.slots }()
+			}
+			if *verbose {
+				log.Printf("running for: %s", key)
+			}
+			runWithRetries(rootCtx, g, *retries)
+		})
 	}
-	return nil
 }
 
-func debounceThen(events <-chan fsnotify.Event, cb func()) {
-	event := <-events
-	if *verbose {
-		log.Printf("event: %s, wait for next\n", event)
+// lazyWatchSet is the watch set for -lazy: the directories below the literal
+// part of each pattern, and literal files as they are. Nothing is globbed,
+// events are matched against the patterns as they come in.
+func lazyWatchSet(dirPatterns []string, excludes []string) ([]string, error) {
+	roots := make([]string, 0)
+	if *useRegex {
+		roots = append(roots, baseDir)
+	} else {
+		for _, pattern := range dirPatterns {
+			if !strings.ContainsAny(pattern, "*?[{") {
+				roots = append(roots, pattern)
+			}
+		}
 	}
 
-LOOP:
-	for {
-		select {
-		case event := <-events:
-			if *verbose {
-				log.Printf("event: %s, wait for next\n", event)
+	files := make([]string, 0)
+	for _, root := range roots {
+		stat, err := os.Stat(root)
+		if err != nil {
+			// Like a glob that matches nothing.
+			continue
+		}
+		if !stat.IsDir() {
+			files = append(files, root)
+			continue
+		}
+		err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-		case <-time.After(time.Duration(*debounceInterval) * time.Second):
-			break LOOP
+			if !info.IsDir() {
+				return nil
+			}
+			if isExcluded(excludes, p) {
+				return filepath.SkipDir
+			}
+			files = append(files, p)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't walk directory: %s %s", root, err)
 		}
 	}
-	cb()
+	return files, nil
 }
 
-func watchForChanges(patterns []string, dirPatterns []string) chan fsnotify.Event {
-	events := make(chan fsnotify.Event)
+// resolvePatterns makes glob patterns absolute and works out the directory
+// patterns whose matches have to be watched to see changes to them.
+func resolvePatterns(patterns []string) ([]string, []string, error) {
+	dirPatterns := make([]string, 0)
+	if *useRegex {
+		// Anything under the base directory may match, so all of it is
+		// watched and new directories there are picked up.
+		depthRoots = append(depthRoots, baseDir)
+		if *relative {
+			dirPatterns = append(dirPatterns, "")
+		} else {
+			dirPatterns = append(dirPatterns, "^"+regexp.QuoteMeta(baseDir)+"(/.*)?$")
+		}
+		if err := compilePatterns(append(patterns, dirPatterns...)); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for i, p := range patterns {
+			if isBasePattern(p) {
+				continue
+			}
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(baseDir, p)
+			}
+			patterns[i] = filepath.Clean(p)
+		}
 
-	go func() {
-		for {
-			select {
-			case event := <-watch.Events:
-                absName, err := filepath.Abs(event.Name)
-                if err != nil {
-                    log.Fatalf("can't get abs path for event: %s %s", event.Name, err)
-                }
-                if event.Op & fsnotify.Create == fsnotify.Create {
-                    for _, pattern := range dirPatterns {
-                            stat, err := os.Stat(absName)
-                            if err != nil {
-                                log.Printf("can't get stat for file: %s, %s", absName, err)
-                            }
-                            if stat.IsDir() {
-                                ok, err := zglob.Match(pattern, absName)
-                                if err != nil {
-                                    log.Fatalf("can't match name: %s", err)
-                                }
-                                if ok {
-                                    addFilesToWatch([]string{absName})
-                                }
-                            }
-                    }
-                }
-                for _, pattern := range patterns {
-                    ok, err := zglob.Match(pattern, absName)
-                    if err != nil {
-                        log.Fatalf("can't match name: %s", err)
-                    }
-                    if *verbose {
-                        log.Printf("will match: %s %s res: %v", pattern, absName, ok)
-                    }
-                    if ok {
-                        if event.Op == fsnotify.Chmod {
-                            continue
-                        }
-                        if *verbose {
-                            log.Printf("event: %+v", event.Name)
-                        }
-                        events <- event
-                    }
-                }
-			case err := <-watch.Errors:
-				if err != nil {
-					log.Fatalf("watch error: %s", err)
-				} else {
-					log.Fatalf("unexpected watch error")
-				}
+		for _, pattern := range patterns {
+			if isBasePattern(pattern) {
+				// The file may turn up anywhere below the base.
+				dirPatterns = append(dirPatterns, baseDir+"/", baseDir+"/**/*")
+				depthRoots = append(depthRoots, baseDir)
+				continue
+			}
+			if i := strings.IndexAny(pattern, "*?[{"); i >= 0 && !*literal {
+				parent := pattern[:i]
+				depthRoots = append(depthRoots, filepath.Dir(parent+"x"))
+				dirPatterns = append(dirPatterns, parent)
+				dirPatterns = append(dirPatterns, parent+"**/*")
+			} else {
+				dirPatterns = append(dirPatterns, pattern)
 			}
 		}
-	}()
+	}
+	return patterns, dirPatterns, nil
+}
 
-	return events
+// watchSet is what to watch and match, from -filenames, -reload-filenames,
+// the patterns file and the ignore file.
+type watchSet struct {
+	patterns    []string
+	dirPatterns []string
+	excludes    []string
+	// restart are the patterns from -filenames alone, nil without
+	// -reload-filenames.
+	restart []string
 }
 
-func runCommand(ctx context.Context, command string) {
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+// loadWatchSet reads the watch set from the flags and files, at startup and
+// on SIGHUP.
+func loadWatchSet() (watchSet, error) {
+	var ws watchSet
+	depthRoots = nil
+	names := strings.Split(os.ExpandEnv(*fileNames), ",")
+	var fileExcludes []string
+	if *patternsFile != "" {
+		fileNames, excludes, err := readPatternsFile(*patternsFile)
+		if err != nil {
+			return ws, err
+		}
+		if *verbose {
+			log.Printf("patterns from %s: %+v, excluding: %+v", *patternsFile, fileNames, excludes)
+		}
+		names = append(names, fileNames...)
+		fileExcludes = excludes
+	}
+	// An empty -filenames, or a stray comma, would otherwise resolve to the
+	// base directory itself.
+	nonEmpty := names[:0]
+	for _, name := range names {
+		if strings.TrimSpace(name) != "" {
+			nonEmpty = append(nonEmpty, name)
+		}
+	}
+	names = nonEmpty
+	for _, name := range names {
+		if err := checkPattern(name, true); err != nil {
+			return ws, fmt.Errorf("bad pattern %s: %s", name, err)
+		}
+	}
+	// -also-run or -reload-filenames alone watch their own files only.
+	if len(names) == 0 && len(routes) == 0 && *reloadFileNames == "" {
+		switch {
+		case *literal:
+			return ws, fmt.Errorf("no files to watch, -literal needs -filenames or -patterns-file")
+		case *useRegex:
+			names = []string{"."}
+		default:
+			names = []string{"**/*"}
+		}
+		log.Printf("no -filenames given, watching everything below %s", baseDir)
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	patterns, dirPatterns, err := resolvePatterns(names)
 	if err != nil {
-		log.Fatalf("can't get stdout for command: %s %s", command, err)
+		return ws, err
 	}
 
-	stderr, err := cmd.StderrPipe()
+	if *reloadFileNames != "" {
+		reloadPatterns, reloadDirPatterns, err := resolvePatterns(strings.Split(os.ExpandEnv(*reloadFileNames), ","))
+		if err != nil {
+			return ws, err
+		}
+		ws.restart = patterns
+		patterns = append(append([]string{}, patterns...), reloadPatterns...)
+		dirPatterns = append(dirPatterns, reloadDirPatterns...)
+	}
+
+	if err := resolveRoutes(); err != nil {
+		return ws, err
+	}
+	if err := resolveLimits(); err != nil {
+		return ws, err
+	}
+	for _, r := range routes {
+		patterns = append(patterns, r.patterns...)
+		dirPatterns = append(dirPatterns, r.dirPatterns...)
+	}
+
+	excludes, err := readIgnoreFile(baseDir)
 	if err != nil {
-		log.Fatalf("can't get stderr for command: %s %s", command, err)
+		return ws, err
+	}
+	if *verbose && len(excludes) > 0 {
+		log.Printf("excluding patterns from %s: %+v", ignoreFileName, excludes)
 	}
+	excludes = append(excludes, fileExcludes...)
+	if *excludeDirs != "" {
+		for _, dir := range strings.Split(os.ExpandEnv(*excludeDirs), ",") {
+			excludes = append(excludes, excludePattern(dir, baseDir))
+		}
+	}
+	ws.patterns, ws.dirPatterns, ws.excludes = patterns, dirPatterns, excludes
+	return ws, nil
+}
 
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("can't start command: %s %s", command, err)
+// expandWatchSet lists the files and directories to watch for ws.
+func expandWatchSet(ws watchSet) ([]string, error) {
+	files := make([]string, 0)
+	if *lazy {
+		var err error
+		files, err = lazyWatchSet(ws.dirPatterns, ws.excludes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, pattern := range ws.dirPatterns {
+			matches, err := expandPattern(pattern, baseDir, ws.excludes)
+			if err != nil {
+				return nil, fmt.Errorf("can't glob pattern: %s %s", pattern, err)
+			}
+			files = append(files, matches...)
+		}
+	}
+	if *depth >= 0 {
+		files = withinDepth(files)
 	}
+	return files, nil
+}
+
+// rootCtx is cancelled when filewatch exits, every run derives from it so
+// nothing outlives filewatch.
+var rootCtx, cancelRoot = context.WithCancel(context.Background())
 
+var exitOnce = new(sync.Once)
+
+// exitCodes receives the code Run returns once filewatch is done.
+var exitCodes = make(chan int, 1)
+
+// finished is closed once Run has returned.
+var finished = make(chan struct{})
+
+// background counts the goroutines of a Run. Run only returns once they're
+// done, so none of them sees the flags of the next one.
+var background = new(sync.WaitGroup)
+
+// gaveUp is set when a second signal has Run return without waiting for
+// them.
+var gaveUp int32
+
+// goBackground runs f in a goroutine Run waits for.
+func goBackground(f func()) {
+	wg := background
+	wg.Add(1)
 	go func() {
-		errScanner := bufio.NewScanner(stderr)
-		for errScanner.Scan() {
-			log.Printf("[STDERR] %s", errScanner.Text())
-		}
+		defer wg.Done()
+		f()
 	}()
+}
 
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		log.Printf("%s", scanner.Text())
+// exitHooks clean up after filewatch, see exit.
+var exitHooks []func()
+
+// atExit registers f to run when filewatch exits through exit.
+func atExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
+// exit stops whatever is running, runs the -on-exit hook and the exit hooks,
+// and has Run return code. It doesn't return, the goroutine calling it ends.
+func exit(code int) {
+	quit(code, true)
+}
+
+// fatal and fatalf log like log.Fatal and log.Fatalf and exit with 1, but
+// without -on-exit, since what it cleans up may never have started. While
+// filewatch is already exiting they only log and return: the -on-exit hook
+// failing with -strict would otherwise wait for its own exit forever.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	if atomic.LoadInt32(&exiting) == 0 {
+		quit(1, false)
 	}
+}
 
-	if err = cmd.Wait(); err != nil {
-		if e, ok := err.(*exec.ExitError); ok {
-			log.Printf("%s", e.ProcessState)
-		} else {
-			log.Printf("can't wait for process: %s %s", command, err)
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	if atomic.LoadInt32(&exiting) == 0 {
+		quit(1, false)
+	}
+}
+
+// exiting is set once quit has started, see fatal.
+var exiting int32
+
+func quit(code int, hooks bool) {
+	codes := exitCodes
+	exitOnce.Do(func() {
+		atomic.StoreInt32(&exiting, 1)
+		// Nothing starts anymore while the -on-exit hook runs.
+		atomic.StoreInt32(&stopping, 1)
+		cancelRoot()
+		killRunning()
+		if hooks && *onExit != "" {
+			runCommand(context.Background(), expandSetEnv(*onExit), "[on-exit] ", trigger{}, false)
+		}
+		for i := len(exitHooks) - 1; i >= 0; i-- {
+			exitHooks[i]()
+		}
+		returnCode(codes, code)
+	})
+	// Another goroutine is already exiting, or Run is returning.
+	runtime.Goexit()
+}
+
+// returnCode has Run return code, unless a second signal had it return
+// already.
+func returnCode(codes chan<- int, code int) {
+	select {
+	case codes <- code:
+	default:
+	}
+}
+
+// exitAfter exits once d has passed and no command is running anymore, or
+// runtimeGrace later at the latest. No run starts in between. A signal
+// meanwhile still exits right away.
+func exitAfter(ctx context.Context, d time.Duration) {
+	if !sleepCtx(ctx, d) {
+		return
+	}
+	atomic.StoreInt32(&stopping, 1)
+	log.Printf("reached -max-runtime of %s, exiting once the running command is done, in %s at the latest", d, runtimeGrace)
+	deadline := time.Now().Add(runtimeGrace)
+	for {
+		stats.Lock()
+		running := stats.running
+		stats.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("command still running after %s, killing it", runtimeGrace)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	exit(0)
+}
+
+// stopping is set once -max-runtime is reached or filewatch exits, no run
+// starts after that.
+var stopping int32
+
+// runtimeGrace is how long a command running when -max-runtime is reached
+// gets to finish. A server never would.
+const runtimeGrace = 10 * time.Second
+
+// exitOnSignal exits on SIGINT or SIGTERM until done is closed. Run doesn't
+// wait for it, it handles a signal while Run waits for everything else.
+func exitOnSignal(codes chan<- int, done <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var sig os.Signal
+	select {
+	case sig = <-signals:
+	case <-done:
+		signal.Stop(signals)
+		return
+	}
+	log.Printf("got %s, exiting", sig)
+	// A second signal gives up on -on-exit and the exit hooks, they may be
+	// what hangs.
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("got %s again, exiting right away", sig)
+			killRunning()
+			atomic.StoreInt32(&gaveUp, 1)
+			returnCode(codes, signalCode(sig))
+		case <-done:
 		}
+	}()
+	exit(signalCode(sig))
+}
 
+// signalCode is the exit code for being stopped by sig, 128 plus its number
+// like a shell reports it.
+func signalCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
 	}
+	return 1
 }
 
 func main() {
-	flag.Parse()
+	os.Exit(Run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Run is filewatch with args as its command line, writing to out and errOut,
+// and returns the exit code once it's done. The flags are parsed anew on
+// every call, starting from their defaults, and what an earlier Run left
+// behind is forgotten. Its goroutines are all done by the time it returns,
+// unless a second signal had it give up on them. What's being watched is
+// still package state though, so Runs can't overlap.
+func Run(args []string, out io.Writer, errOut io.Writer) int {
+	stdout, stderr = out, errOut
+	log.SetOutput(stderr)
+	jsonOut.enc = json.NewEncoder(stdout)
+	fs := flags.newFlagSet(stderr)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	notifySeparately = false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "notify-t" {
+			notifySeparately = true
+		}
+	})
+	resetState()
+	if *tag != "" {
+		log.SetPrefix(*tag + " ")
+	}
+	goBackground(watchAndRun)
+	defer close(finished)
+	code := <-exitCodes
+	// After a second signal whatever hangs is left behind.
+	if atomic.LoadInt32(&gaveUp) == 0 {
+		background.Wait()
+	}
+	return code
+}
+
+// resetState puts the package state back to how a Run starts out.
+func resetState() {
+	log.SetPrefix("")
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+	exitOnce = new(sync.Once)
+	exitCodes = make(chan int, 1)
+	finished = make(chan struct{})
+	background = new(sync.WaitGroup)
+	atomic.StoreInt32(&gaveUp, 0)
+	exitHooks = nil
+	atomic.StoreInt32(&exiting, 0)
+	atomic.StoreInt32(&stopping, 0)
+
+	matcher = zglobber{}
+	outputRewriter = nil
+	onWatchChange = nil
+	gitHead = ""
+	removals = nil
+	maxFileBytes, minSizeBytes, minSizePercent = 0, 0, 0
+	commandDir = ""
+	outputPatterns, recurseRoots, depthRoots = nil, nil, nil
+	successCodeSet = map[int]bool{0: true}
+	polled, baseDev = nil, 0
+	sock = nil
+	tracked = nil
+	atomic.StoreInt64(&lastRunID, 0)
+	atomic.StoreInt64(&droppedChanges, 0)
+	pendingDirs = make(map[string]*dirWindow)
+	setRestartPatterns(nil)
+
+	stats.Lock()
+	stats.lastEvent, stats.events, stats.running, stats.lastRunFailed = time.Time{}, 0, 0, false
+	stats.Unlock()
+	symlinks.Lock()
+	symlinks.m = make(map[string]string)
+	symlinks.Unlock()
+	regexps.Lock()
+	regexps.m = make(map[string]*regexp.Regexp)
+	regexps.Unlock()
+	sizes.Lock()
+	sizes.m = make(map[string]int64)
+	sizes.Unlock()
+	inodes.Lock()
+	inodes.m = make(map[fileID]string)
+	inodes.Unlock()
+	stabilizing.Lock()
+	stabilizing.m = make(map[string]bool)
+	stabilizing.Unlock()
+	processes.Lock()
+	processes.m = make(map[*os.Process]bool)
+	processes.Unlock()
+	previousOutput.Lock()
+	previousOutput.m = make(map[string]string)
+	previousOutput.Unlock()
+	keyLocks.Lock()
+	keyLocks.m = make(map[string]*sync.Mutex)
+	keyLocks.Unlock()
+	pollRoots.Lock()
+	pollRoots.m = make(map[string]chan struct{})
+	pollRoots.Unlock()
+	savedState.Lock()
+	savedState.ws, savedState.files = watchSet{}, nil
+	savedState.Unlock()
+	lastDump.at, lastDump.events = time.Now(), 0
+}
+
+// watchAndRun sets up the watch from the flags and runs commands on changes
+// until exit is called.
+func watchAndRun() {
+	// exited is done once filewatch exits, the goroutines started here end
+	// with it.
+	exited := rootCtx
+	if *verbosity >= 1 {
+		*verbose = true
+	}
 
 	if *verbose {
 		log.Printf("filewatch version 0.0.4\n")
@@ -172,68 +3110,363 @@ func main() {
 	var err error
 	watch, err = fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer watch.Close()
+	// Closing the watch once filewatch exits ends everything reading its
+	// events, the main loop below included.
+	w := watch
+	goBackground(func() {
+		<-exited.Done()
+		w.Close()
+		stopPolling()
+	})
 
+	if *noDebounce {
+		if *strategyName != "debounce" {
+			fatalf("-no-debounce and -strategy can't be used together")
+		}
+		*strategyName = "immediate"
+	}
+	m, ok := matchers[*matcherName]
+	if !ok {
+		fatalf("unknown -matcher value: %s, use zglob or doublestar", *matcherName)
+	}
+	matcher = m
+	waitForChange, ok := strategies[*strategyName]
+	if !ok {
+		fatalf("unknown -strategy value: %s, use one of %s", *strategyName, strategyNames())
+	}
 
-	files := make([]string, 0)
+	if *dirsOnly && *filesOnly {
+		fatalf("-dirs-only and -files-only can't be used together")
+	}
+	if *literal && *useRegex {
+		fatalf("-literal and -regex can't be used together")
+	}
+	if *reloadFileNames != "" && *reloadCommand == "" {
+		fatalf("-reload-filenames needs -reload-command to run for them")
+	}
+	if *lockFile != "" && !lockSupported {
+		fatalf("-lockfile isn't supported on Windows")
+	}
+	if *strategyName == "dir" {
+		if *serializeBy == "file" {
+			fatalf("-strategy dir runs once per directory, it can't be used with -serialize-by file")
+		}
+		*serializeBy = "dir"
+	}
+	if *bell != "" && *bell != "always" && *bell != "failure" {
+		fatalf("unknown -bell value: %s, use always or failure", *bell)
+	}
+	if len(limits) > 0 && *serializeBy == "" {
+		fatalf("-max-parallel-per-pattern limits -serialize-by runs, it needs -serialize-by or -strategy dir")
+	}
+	if *serializeBy != "" && *serializeBy != "file" && *serializeBy != "dir" {
+		fatalf("unknown -serialize-by value: %s", *serializeBy)
+	}
 
-	patterns := strings.Split(*fileNames, ",")
-    for i, p := range patterns {
-        absPattern, err := filepath.Abs(p)
-        if err != nil {
-            log.Fatalf("can't get absolute path for pattern: %s %s", p, err)
-        }
-        patterns[i] =  absPattern
-    }
+	for i, c := range commands {
+		commands[i] = expandSetEnv(c)
+	}
+	*onlyIf = expandSetEnv(*onlyIf)
 
-    dirPatterns := make([]string, 0)
-	for _, pattern := range patterns {
-        parent := strings.SplitN(pattern, "*", 2)
-        if parent[0] != pattern {
-            dirPatterns = append(dirPatterns, parent[0])
-            dirPatterns = append(dirPatterns, parent[0] + "**/*")
-        } else {
-            dirPatterns = append(dirPatterns, pattern)
-        }
-    }
-
-	for _, pattern := range dirPatterns {
-        matches, err := zglob.Glob(pattern)
-        if err != nil {
-            log.Fatalf("can't glob pattern: %s %s", pattern, err)
-        }
-        for _, match := range matches {
-            files = append(files, match)
-        }
-    }
-    if *verbose {
-        log.Printf("watching for files: %+v", files)
-    }
+	if *maxFileSize != "" {
+		maxFileBytes, err = parseSize(*maxFileSize)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *minSizeChange != "" {
+		if err := parseSizeChange(*minSizeChange); err != nil {
+			fatal(err)
+		}
+	}
+	if *largeFiles != "ignore" && *largeFiles != "trigger" {
+		fatalf("unknown -large-files value: %s", *largeFiles)
+	}
+
+	successCodeSet, err = parseSuccessCodes(*successCodes)
+	if err != nil {
+		fatal(err)
+	}
+
+	stats.watched = make(map[string]bool)
+	stats.dirs = make(map[string]bool)
+	if *verbose {
+		onWatchChange = func(added []string, removed []string) {
+			if len(added) > 0 {
+				log.Printf("watches added: %+v", added)
+			}
+			if len(removed) > 0 {
+				log.Printf("watches removed: %+v", removed)
+			}
+		}
+	}
+	baseDir = *base
+	if baseDir == "" {
+		baseDir = "."
+	}
+	baseDir, err = filepath.Abs(baseDir)
+	if err != nil {
+		fatalf("can't get absolute path for base: %s %s", *base, err)
+	}
+
+	// Editors jumping to errors want paths relative to where they have the
+	// project open.
+	if *relativeOutput {
+		rewrites = append(rewrites, baseDir+string(filepath.Separator), "")
+	}
+	if len(rewrites) > 0 {
+		outputRewriter = strings.NewReplacer(rewrites...)
+	}
+
+	if *pollMounts > 0 {
+		dev, ok := deviceOf(baseDir)
+		if !ok {
+			fatalf("-poll-mounts isn't supported on this platform")
+		}
+		baseDev = dev
+		polled = make(chan fsnotify.Event, *eventBuffer)
+	}
+
+	if *cwd != "" {
+		commandDir = os.ExpandEnv(*cwd)
+		if !filepath.IsAbs(commandDir) {
+			commandDir = filepath.Join(baseDir, commandDir)
+		}
+		if stat, err := os.Stat(commandDir); err != nil || !stat.IsDir() {
+			fatalf("can't use -cwd, not a directory: %s", commandDir)
+		}
+	}
+
+	// Commands run in process groups of their own, out of reach of a
+	// Ctrl-C, so nothing may run before exitOnSignal is there to kill them.
+	go exitOnSignal(exitCodes, finished)
+
+	if *initialBlocking {
+		runWithRetries(rootCtx, trigger{}, initialRetries())
+	}
+
+	if *outputs != "" {
+		for _, p := range strings.Split(os.ExpandEnv(*outputs), ",") {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(baseDir, p)
+			}
+			outputPatterns = append(outputPatterns, filepath.Clean(p))
+		}
+	}
+	if *recurseUnder != "" {
+		for _, root := range strings.Split(os.ExpandEnv(*recurseUnder), ",") {
+			if !filepath.IsAbs(root) {
+				root = filepath.Join(baseDir, root)
+			}
+			recurseRoots = append(recurseRoots, filepath.Clean(root))
+		}
+	}
+
+	ws, err := loadWatchSet()
+	if err != nil {
+		fatal(err)
+	}
+	setRestartPatterns(ws.restart)
+	setRoot(ws.patterns)
+	if *gitTracked {
+		if err := loadTracked(); err != nil {
+			fatal(err)
+		}
+	}
+	patterns, dirPatterns, excludes := ws.patterns, ws.dirPatterns, ws.excludes
+	var files []string
+	fromState := false
+	if *stateFile != "" {
+		files, fromState = loadState(*stateFile, ws)
+	}
+	if !fromState {
+		files, err = expandWatchSet(ws)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *stateFile != "" {
+		rememberState(ws, files)
+		atExit(func() {
+			if err := saveState(*stateFile); err != nil {
+				log.Print(err)
+			}
+		})
+	}
+	if *verbose {
+		log.Printf("settings: strategy %s, debounce %s, base %s, root %s, excludes %+v", *strategyName, &debounceInterval, baseDir, rootDir, excludes)
+		log.Printf("watching for files: %+v", files)
+	}
+	if *trackInodes {
+		for _, f := range files {
+			for _, pattern := range patterns {
+				if ok, _ := matchPattern(pattern, f); ok {
+					rememberInode(pattern, f)
+				}
+			}
+		}
+	}
+
+	if *minSizeChange != "" {
+		for _, f := range files {
+			rememberSize(f)
+		}
+	}
 
 	if err := addFilesToWatch(files); err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if *gitBranchAware {
+		gitDir := filepath.Join(baseDir, ".git")
+		gitHead = filepath.Join(gitDir, "HEAD")
+		// Git replaces HEAD rather than writing to it, so watch the
+		// directory it lives in.
+		if err := addFilesToWatch([]string{gitDir}); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *watchIgnoreFile {
+		// Its directory, so the ignore file is seen when it's created or
+		// replaced too.
+		if err := addFilesToWatch([]string{baseDir}); err != nil {
+			fatal(err)
+		}
+	}
+
+	for _, r := range routes {
+		r.events = make(chan fsnotify.Event, *eventBuffer)
+		r := r
+		goBackground(func() { runRoute(exited, r) })
+	}
+
+	if *onRemove != "" {
+		removals = newRemovalQueue()
+		goBackground(func() { handleRemovals(exited, removals) })
+	}
+
+	var raw <-chan fsnotify.Event = watch.Events
+	if polled != nil {
+		raw = mergeEvents(watch.Events)
+	}
+	reloads := make(chan struct{})
+	goBackground(func() { reloadOnSignal(exited, reloads) })
+	events, ready := watchForChanges(raw, watch.Errors, reloads, patterns, dirPatterns, excludes)
+	// Nothing that could change files starts before events are being read.
+	<-ready
+
+	// The socket is there before anything reports changes to it.
+	if *socketPath != "" {
+		sock, err = listenSocket(*socketPath)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if notifySeparately {
+		var notifyEvents chan fsnotify.Event
+		events, notifyEvents = tee(events)
+		goBackground(func() { notifyChanges(notifyEvents) })
+	}
+
+	if *heartbeat > 0 {
+		goBackground(func() { logHeartbeat(exited, *heartbeat) })
 	}
 
-	events := watchForChanges(patterns, dirPatterns)
+	goBackground(func() { logStateOnSignal(exited) })
+	if *maxRuntime > 0 {
+		goBackground(func() { exitAfter(exited, *maxRuntime) })
+	}
+	if *onStart != "" {
+		runCommand(rootCtx, expandSetEnv(*onStart), "[on-start] ", trigger{}, false)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(rootCtx)
 	defer cancel()
-	if *initial {
-		go runCommand(ctx, *command)
+	// done is closed once the latest run started in the background is
+	// over, its command included.
+	done := make(chan struct{})
+	close(done)
+	if *initial && !*initialBlocking {
+		if *noRestart || *waitComplete {
+			runWithRetries(ctx, trigger{}, initialRetries())
+		} else {
+			done = make(chan struct{})
+			ctx, done := ctx, done
+			goBackground(func() {
+				defer close(done)
+				runWithRetries(ctx, trigger{}, initialRetries())
+			})
+		}
 	}
 
-	for {
-		debounceThen(events, func() {
-			if *command == "" {
-				os.Exit(0)
+	for exited.Err() == nil {
+		waitForChange(events, func(changed []fsnotify.Event) {
+			// What was collected when the watch closed.
+			if exited.Err() != nil {
+				return
+			}
+			if len(commands) == 0 && sock == nil && !*printChanged && !*jsonOutput && *webhook == "" {
+				if len(routes) > 0 {
+					return
+				}
+				exit(0)
+				return
+			}
+
+			t := newTrigger(changed)
+			if !notifySeparately {
+				notify(t)
+			}
+			if needsReloadOnly(t) {
+				goBackground(func() { runCommand(rootCtx, expandSetEnv(*reloadCommand), "[reload] ", t, false) })
+				return
+			}
+			if *serializeBy != "" {
+				// Keyed runs wait for each other rather than being
+				// cancelled, and for the initial run too.
+				<-done
+				runKeyed(t)
+				return
+			}
+
+			// Running in the loop itself keeps the strategy from reading
+			// events until the command is done, so whatever piled up
+			// meanwhile starts a fresh debounce window afterwards.
+			if *noRestart || *waitComplete {
+				runWithRetries(ctx, t, *retries)
 				return
 			}
 
+			stats.Lock()
+			restart := stats.running > 0
+			stats.Unlock()
 			cancel()
-			ctx, cancel = context.WithCancel(context.Background())
-			go runCommand(ctx, *command)
+			ctx, cancel = context.WithCancel(rootCtx)
+			previous := done
+			done = make(chan struct{})
+			ctx, done := ctx, done
+			goBackground(func() {
+				defer close(done)
+				// Two instances of a server mustn't run at the same
+				// time, not even briefly.
+				<-previous
+				// A server that was just killed may hold on to its port
+				// for a moment.
+				if restart && *gracePeriod > 0 {
+					sleepCtx(ctx, *gracePeriod)
+				}
+				// A newer change or exiting may have cancelled the run
+				// meanwhile, starting it would only report it killed.
+				if ctx.Err() != nil {
+					return
+				}
+				runWithRetries(ctx, t, *retries)
+			})
 		})
 	}
 
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// defaultFlags puts the flags back at their defaults for the tests that
+// follow.
+func defaultFlags() {
+	flags.newFlagSet(ioutil.Discard).Parse(nil)
+}
+
+func TestFlagsStartOver(t *testing.T) {
+	defer defaultFlags()
+	if err := flags.newFlagSet(ioutil.Discard).Parse([]string{"-command", "a", "-command", "b", "-t", "2s", "-verbose"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.newFlagSet(ioutil.Discard).Parse([]string{"-command", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(commands, commandList{"c"}) {
+		t.Errorf("commands are %v, want [c]", commands)
+	}
+	if debounceInterval.interval != 0 || *verbose {
+		t.Errorf("-t is %s and -verbose %t, want the defaults", &debounceInterval, *verbose)
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	defer defaultFlags()
+	for i := 0; i < 2; i++ {
+		var out, errOut bytes.Buffer
+		codes := make(chan int, 1)
+		go func() { codes <- Run([]string{"-literal"}, &out, &errOut) }()
+		select {
+		case code := <-codes:
+			if code != 1 {
+				t.Errorf("run %d exits with %d, want 1", i, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d doesn't return", i)
+		}
+		if !bytes.Contains(errOut.Bytes(), []byte("-literal needs -filenames")) {
+			t.Errorf("run %d logs %q", i, errOut.String())
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer filewatch's goroutines can write to at once.
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
+func TestRunTwiceWatching(t *testing.T) {
+	defer defaultFlags()
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"out", "src"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first run has out as its -output, which the second one mustn't
+	// inherit, and neither its -tag.
+	runs := []struct {
+		args    []string
+		changes string
+	}{
+		{[]string{"-tag", "first", "-output", "out", "-filenames", "src"}, "src"},
+		{[]string{"-filenames", "out"}, "out"},
+	}
+	for i, run := range runs {
+		var out, errOut syncBuffer
+		args := append([]string{"-base", dir, "-t", "50ms", "-max-runtime", "1s", "-command", "echo ran"}, run.args...)
+		codes := make(chan int, 1)
+		go func() { codes <- Run(args, &out, &errOut) }()
+
+		// The watch is set up at some point after Run starts.
+		deadline := time.Now().Add(time.Second)
+		for !strings.Contains(errOut.String(), "ran") && time.Now().Before(deadline) {
+			f, err := os.OpenFile(filepath.Join(dir, run.changes), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("x\n")
+			f.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+		select {
+		case code := <-codes:
+			if code != 0 {
+				t.Errorf("run %d exits with %d, want 0", i, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d doesn't return", i)
+		}
+		logged := errOut.String()
+		if !strings.Contains(logged, "ran") {
+			t.Errorf("run %d doesn't run for a change to %s, logs %q", i, run.changes, logged)
+		}
+		if i > 0 && strings.Contains(logged, "first ") {
+			t.Errorf("run %d logs with the -tag of the first one: %q", i, logged)
+		}
+	}
+}
+
+func TestExpandSetEnv(t *testing.T) {
+	os.Setenv("FILEWATCH_TEST_DIR", "/src")
+	defer os.Unsetenv("FILEWATCH_TEST_DIR")
+	os.Unsetenv("FILEWATCH_TEST_UNSET")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"$FILEWATCH_TEST_DIR/*.go", "/src/*.go"},
+		{"${FILEWATCH_TEST_DIR}/*.go", "/src/*.go"},
+		{"for f in *; do echo $f; done", "for f in *; do echo $f; done"},
+		{"awk '{print $2}' f", "awk '{print $2}' f"},
+		{"echo ${FILEWATCH_TEST_UNSET} $FILEWATCH_TEST_UNSET", "echo ${FILEWATCH_TEST_UNSET} $FILEWATCH_TEST_UNSET"},
+		{"echo ${FILEWATCH_TEST_UNSET:-x} $$ $", "echo ${FILEWATCH_TEST_UNSET:-x} $$ $"},
+		{"echo ${unclosed", "echo ${unclosed"},
+	}
+	for _, test := range tests {
+		if got := expandSetEnv(test.in); got != test.want {
+			t.Errorf("expandSetEnv(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestExpandSkipsExcludedDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"src/a.go", "src/node_modules/x/b.go", "node_modules/c.go", "src/d/e.go"} {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visited := make([]string, 0)
+	defer func(w func(string, filepath.WalkFunc) error) { walk = w }(walk)
+	walk = func(root string, fn filepath.WalkFunc) error {
+		return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			visited = append(visited, p)
+			return fn(p, info, err)
+		})
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"**/*.go", []string{"src/a.go", "src/d/e.go"}},
+		{"src/*/*.go", []string{"src/d/e.go"}},
+	}
+	for _, test := range tests {
+		visited = visited[:0]
+		ws := watchSet{dirPatterns: []string{filepath.Join(dir, test.pattern)}, excludes: []string{excludePattern("node_modules", dir)}}
+		files, err := expandWatchSet(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range files {
+			files[i], _ = filepath.Rel(dir, f)
+		}
+		if !reflect.DeepEqual(files, test.want) {
+			t.Errorf("%s expands to %v, want %v", test.pattern, files, test.want)
+		}
+		if len(visited) == 0 {
+			t.Errorf("%s is expanded without walking", test.pattern)
+		}
+		for _, p := range visited {
+			if strings.Contains(p, "node_modules"+string(filepath.Separator)) {
+				t.Errorf("%s visits %s below an excluded directory", test.pattern, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// polled is fed the events of the directories polled instead of watched in
+// -poll-mounts mode, nil otherwise.
+var polled chan fsnotify.Event
+
+// baseDev is the device -base is on. Directories on other devices are polled.
+var baseDev uint64
+
+// pollRoots are the directories being polled, each with the channel that
+// stops its polling.
+var pollRoots = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+// pollInstead reports whether name is on another filesystem than -base and
+// gets polled rather than watched, and starts polling it, or the directory
+// of a file, if that hasn't happened yet. Network and FUSE filesystems often
+// don't deliver inotify events at all. Only what's watched is polled, not
+// the whole mount it's on.
+func pollInstead(name string) bool {
+	if polled == nil {
+		return false
+	}
+	dev, ok := deviceOf(name)
+	if !ok || dev == baseDev {
+		return false
+	}
+	root := name
+	if stat, err := os.Stat(name); err == nil && !stat.IsDir() {
+		root = filepath.Dir(name)
+	}
+
+	pollRoots.Lock()
+	defer pollRoots.Unlock()
+	for polling := range pollRoots.m {
+		if isUnder(root, polling) {
+			return true
+		}
+	}
+	// Polling root covers whatever is polled below it already.
+	for polling, stop := range pollRoots.m {
+		if isUnder(polling, root) {
+			close(stop)
+			delete(pollRoots.m, polling)
+		}
+	}
+	stop := make(chan struct{})
+	pollRoots.m[root] = stop
+	log.Printf("polling %s every %s, it's on another filesystem", root, *pollMounts)
+	goBackground(func() { poll(root, *pollMounts, stop) })
+	return true
+}
+
+func deviceOf(name string) (uint64, bool) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return 0, false
+	}
+	id, ok := getFileID(stat)
+	return id.dev, ok
+}
+
+// pollState is what poll remembers of a file between two walks.
+type pollState struct {
+	modTime time.Time
+	size    int64
+}
+
+// poll walks root every interval and reports what changed in between as
+// fsnotify events, until stop is closed.
+func poll(root string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	events := polled
+	send := func(event fsnotify.Event) bool {
+		select {
+		case events <- event:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	last := walkState(root)
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		current := walkState(root)
+		for name, state := range current {
+			old, ok := last[name]
+			switch {
+			case !ok:
+				if !send(fsnotify.Event{Name: name, Op: fsnotify.Create}) {
+					return
+				}
+			case state != old:
+				if !send(fsnotify.Event{Name: name, Op: fsnotify.Write}) {
+					return
+				}
+			}
+		}
+		for name := range last {
+			if _, ok := current[name]; !ok {
+				if !send(fsnotify.Event{Name: name, Op: fsnotify.Remove}) {
+					return
+				}
+			}
+		}
+		last = current
+	}
+}
+
+// stopPolling stops polling everything, once filewatch exits.
+func stopPolling() {
+	pollRoots.Lock()
+	defer pollRoots.Unlock()
+	for polling, stop := range pollRoots.m {
+		close(stop)
+		delete(pollRoots.m, polling)
+	}
+}
+
+func walkState(root string) map[string]pollState {
+	state := make(map[string]pollState)
+	// The trailing separator has a mount reached through a symlink walked.
+	root += string(filepath.Separator)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && p != root {
+			state[p] = pollState{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return state
+}
+
+// mergeEvents passes on the events of the watcher and of polling on one
+// channel.
+func mergeEvents(watched <-chan fsnotify.Event) <-chan fsnotify.Event {
+	merged := make(chan fsnotify.Event)
+	events := polled
+	goBackground(func() {
+		for {
+			select {
+			case event, ok := <-watched:
+				if !ok {
+					close(merged)
+					return
+				}
+				merged <- event
+			case event := <-events:
+				merged <- event
+			}
+		}
+	})
+	return merged
+}
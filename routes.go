@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// route is an -also-run entry: changes to files matching names run command,
+// debounced on their own rather than along with -command.
+type route struct {
+	names   string
+	command string
+	// patterns are names resolved like -filenames, see loadWatchSet.
+	patterns    []string
+	dirPatterns []string
+	events      chan fsnotify.Event
+}
+
+// routeList collects every -also-run flag.
+type routeList []*route
+
+var routes routeList
+
+func (r *routeList) String() string {
+	entries := make([]string, len(*r))
+	for i, rt := range *r {
+		entries[i] = rt.names + "=" + rt.command
+	}
+	return strings.Join(entries, ", ")
+}
+
+func (r *routeList) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("-also-run must look like patterns=command: %s", value)
+	}
+	*r = append(*r, &route{names: value[:i], command: value[i+1:]})
+	return nil
+}
+
+func (r *routeList) reset() {
+	*r = nil
+}
+
+func init() {
+	flags.Var(&routes, "also-run", "run a command of its own for changes to these files, debounced separately, given as patterns=command, may be repeated")
+}
+
+// resolveRoutes resolves the patterns of every route.
+func resolveRoutes() error {
+	for _, r := range routes {
+		patterns, dirPatterns, err := resolvePatterns(strings.Split(os.ExpandEnv(r.names), ","))
+		if err != nil {
+			return err
+		}
+		r.patterns, r.dirPatterns = patterns, dirPatterns
+	}
+	return nil
+}
+
+// routeFor returns the first route whose patterns match name, nil if none
+// does. A file claimed by a route doesn't run -command.
+func routeFor(name string) *route {
+	for _, r := range routes {
+		if matchesAny(r.patterns, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// runRoute debounces the changes routed to r and runs its command for them.
+// A run isn't cancelled by the next change, that waits for it instead: an
+// interrupted dependency download is worse than a late one. It returns once
+// ctx is done.
+func runRoute(ctx context.Context, r *route) {
+	prefix := "[" + r.names + "] "
+	for ctx.Err() == nil {
+		debounceThen(r.events, func(changed []fsnotify.Event) {
+			if ctx.Err() != nil {
+				return
+			}
+			t := newTrigger(changed)
+			if *verbose {
+				log.Printf("%schanged: %s", prefix, describeFiles(t.files))
+			}
+			runCommand(ctx, expandSetEnv(r.command), prefix, t, *detach)
+		})
+	}
+}
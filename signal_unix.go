@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpSignals has SIGUSR2 delivered to c to ask for logState.
+func dumpSignals(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR2)
+	return true
+}
+
+// reloadSignals has SIGHUP delivered to c to ask for the watch set to be
+// reloaded.
+func reloadSignals(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGHUP)
+	return true
+}
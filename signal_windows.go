@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// dumpSignals isn't supported on Windows, there's no SIGUSR2.
+func dumpSignals(c chan<- os.Signal) bool {
+	return false
+}
+
+// reloadSignals isn't supported on Windows, there's no SIGHUP.
+func reloadSignals(c chan<- os.Signal) bool {
+	return false
+}
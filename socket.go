@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// sock is the -socket listener, nil if there's none.
+var sock *socketServer
+
+// socketServer hands every debounced change to all connected clients.
+type socketServer struct {
+	sync.Mutex
+	listener net.Listener
+	clients  map[net.Conn]bool
+}
+
+// socketRecord is one line written to the socket, and the body of -webhook
+// requests.
+type socketRecord struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Files []string  `json:"files"`
+}
+
+func listenSocket(path string) (*socketServer, error) {
+	// A socket left behind by a filewatch that was killed would make Listen
+	// fail, refuse to remove anything else though.
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on socket: %s %s", path, err)
+	}
+	s := &socketServer{listener: listener, clients: make(map[net.Conn]bool)}
+	atExit(func() {
+		listener.Close()
+		os.Remove(path)
+	})
+	goBackground(s.accept)
+	return s, nil
+}
+
+func (s *socketServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if *verbose {
+			log.Printf("socket client connected")
+		}
+		s.Lock()
+		s.clients[conn] = true
+		s.Unlock()
+	}
+}
+
+func (s *socketServer) send(t trigger) {
+	line, err := json.Marshal(socketRecord{Event: "change", Time: time.Now(), Files: t.files})
+	if err != nil {
+		log.Printf("can't encode change for socket: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	for conn := range s.clients {
+		// A client that stopped reading mustn't hold up everybody else.
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(line); err != nil {
+			if *verbose {
+				log.Printf("socket client gone: %s", err)
+			}
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+}
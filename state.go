@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var stateFile = flags.String("state-file", "", "keep the expanded watch set in this file on exit and start from it instead of globbing, unless what it covers changed meanwhile")
+
+// watchState is what -state-file holds: the watch set's files and the
+// modification times of the directories they were globbed from. A file
+// created or removed in one of them changes its time, which makes the whole
+// state stale.
+type watchState struct {
+	Key   string           `json:"key"`
+	Files []string         `json:"files"`
+	Dirs  map[string]int64 `json:"dirs"`
+}
+
+// savedState is the watch set written to -state-file on exit, updated on
+// every reload.
+var savedState struct {
+	sync.Mutex
+	ws    watchSet
+	files []string
+}
+
+// stateKey identifies the settings a watch set was expanded with, a state
+// saved with others can't be used.
+func stateKey(ws watchSet) string {
+	return fmt.Sprintf("%s %q %q %s %d %t %t %t", baseDir, ws.dirPatterns, ws.excludes, *matcherName, *depth, *useRegex, *literal, *lazy)
+}
+
+// stateDirs are the directories whose modification times tell whether files
+// could have appeared in or vanished from the watch set: those of the files,
+// the directories in it, and where each pattern's wildcards start.
+func stateDirs(ws watchSet, files []string) []string {
+	dirs := make([]string, 0, len(files))
+	for _, f := range files {
+		dirs = append(dirs, filepath.Dir(f))
+		if stat, err := os.Stat(f); err == nil && stat.IsDir() {
+			dirs = append(dirs, f)
+		}
+	}
+	for _, pattern := range ws.dirPatterns {
+		if i := strings.IndexAny(pattern, "*?[{"); i >= 0 {
+			pattern = pattern[:i]
+		}
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+	return dirs
+}
+
+// modTime is the modification time of dir, 0 if it doesn't exist.
+func modTime(dir string) int64 {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return 0
+	}
+	return stat.ModTime().UnixNano()
+}
+
+// rememberState keeps files as the watch set to save for ws.
+func rememberState(ws watchSet, files []string) {
+	savedState.Lock()
+	savedState.ws, savedState.files = ws, files
+	savedState.Unlock()
+}
+
+// saveState writes the remembered watch set to path.
+func saveState(path string) error {
+	savedState.Lock()
+	ws, files := savedState.ws, savedState.files
+	savedState.Unlock()
+	if files == nil {
+		return nil
+	}
+	// Creating the file changes its directory, which may be one of the
+	// watch set's, so it's created before the times are taken and only
+	// written to afterwards.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can't save state: %s %s", path, err)
+	}
+	defer f.Close()
+	state := watchState{Key: stateKey(ws), Files: files, Dirs: make(map[string]int64)}
+	for _, dir := range stateDirs(ws, files) {
+		state.Dirs[dir] = modTime(dir)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("can't save state: %s %s", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("can't save state: %s %s", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("can't save state: %s %s", path, err)
+	}
+	return nil
+}
+
+// loadState returns the watch set saved in path for ws, false if there is
+// none or it's stale. Files that are gone are dropped, a directory that
+// changed invalidates everything since its new entries would need globbing.
+func loadState(path string, ws watchSet) ([]string, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("can't read state, globbing instead: %s %s", path, err)
+		}
+		return nil, false
+	}
+	var state watchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("can't read state, globbing instead: %s %s", path, err)
+		return nil, false
+	}
+	if state.Key != stateKey(ws) {
+		if *verbose {
+			log.Printf("state was saved with other settings, globbing instead")
+		}
+		return nil, false
+	}
+	for dir, t := range state.Dirs {
+		if modTime(dir) != t {
+			if *verbose {
+				log.Printf("state is stale, %s changed, globbing instead", dir)
+			}
+			return nil, false
+		}
+	}
+	files := make([]string, 0, len(state.Files))
+	for _, f := range state.Files {
+		if _, err := os.Lstat(f); err != nil {
+			if *verbose {
+				log.Printf("dropping from state, gone: %s", f)
+			}
+			continue
+		}
+		files = append(files, f)
+	}
+	if *verbose {
+		log.Printf("watch set loaded from state: %s", path)
+	}
+	return files, true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// strategy decides when a change should lead to a run. It waits for events
+// as it sees fit and calls cb once with the ones that make up that change.
+// The main loop calls it over and over.
+type strategy func(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event))
+
+// strategies are the values -strategy accepts.
+var strategies = map[string]strategy{
+	"debounce":  debounceThen,
+	"throttle":  throttleThen,
+	"batch":     batchThen,
+	"adaptive":  adaptiveThen,
+	"immediate": immediateThen,
+	"dir":       perDirThen,
+}
+
+func strategyNames() string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// throttleThen runs right away on the first event and then not again for the
+// interval. Events coming in meanwhile stay queued and make the next call
+// run as soon as the interval is over.
+func throttleThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	event, ok := <-events
+	if !ok {
+		return
+	}
+	changed := append([]fsnotify.Event{event}, drain(events)...)
+	holdOff := clk.After(eventInterval(event))
+	if *verbose {
+		log.Printf("event: %s, running now", event)
+	}
+	cb(changed)
+	<-holdOff
+}
+
+// batchThen collects events for a fixed interval from the first one and
+// runs with all of them, however busy it gets in between.
+func batchThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	event, ok := <-events
+	if !ok {
+		return
+	}
+	changed := newChangeSet(event)
+	window := clk.After(eventInterval(event))
+	if *verbose {
+		log.Printf("event: %s, batching", event)
+	}
+
+LOOP:
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				break LOOP
+			}
+			changed.add(event)
+		case <-window:
+			break LOOP
+		}
+	}
+	cb(changed.events)
+}
+
+// adaptiveThen debounces like debounceThen, but waits for the interval once
+// per distinct file changed, up to -adaptive-max. A single save runs after
+// one interval, while a checkout touching hundreds of files gets the time to
+// finish.
+func adaptiveThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	debounceScaled(events, cb, func(interval time.Duration, files int) time.Duration {
+		quiet := interval * time.Duration(files)
+		if quiet > *adaptiveMax {
+			quiet = *adaptiveMax
+		}
+		return quiet
+	})
+}
+
+// droppedChanges counts the events for files a changeSet left out since the
+// last newTrigger.
+var droppedChanges int64
+
+// changeSet collects the events of a change, one per file and at most
+// -max-changes files. Cloning a repository into a watched directory
+// shouldn't keep every path in memory until things calm down, and a file
+// written over and over shouldn't crowd out the others.
+type changeSet struct {
+	events []fsnotify.Event
+	seen   map[string]bool
+}
+
+func newChangeSet(event fsnotify.Event) *changeSet {
+	return &changeSet{events: []fsnotify.Event{event}, seen: map[string]bool{event.Name: true}}
+}
+
+// add adds event. One for a file already in the set replaces the earlier
+// one and moves the file to the end, as the most recently changed.
+func (c *changeSet) add(event fsnotify.Event) {
+	if c.seen[event.Name] {
+		for i := len(c.events) - 1; i >= 0; i-- {
+			if c.events[i].Name == event.Name {
+				c.events = append(c.events[:i], c.events[i+1:]...)
+				break
+			}
+		}
+		c.events = append(c.events, event)
+		return
+	}
+	if len(c.events) >= *maxChanges {
+		atomic.AddInt64(&droppedChanges, 1)
+		return
+	}
+	c.seen[event.Name] = true
+	c.events = append(c.events, event)
+}
+
+// immediateThen runs for every event on its own as soon as it arrives. Only
+// the duplicates dropped by -buffer are merged.
+func immediateThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	event, ok := <-events
+	if !ok {
+		return
+	}
+	if *verbose {
+		log.Printf("event: %s, running now", event)
+	}
+	cb([]fsnotify.Event{event})
+}
+
+// dirWindow is a directory perDirThen is waiting to go quiet.
+type dirWindow struct {
+	changed *changeSet
+	due     time.Time
+}
+
+// pendingDirs outlives a single call of perDirThen, since it returns as soon
+// as one directory is done and the others are still waiting.
+var pendingDirs = make(map[string]*dirWindow)
+
+// perDirThen debounces every directory on its own and calls cb with the
+// events of the first one to have been quiet for the interval. The main loop
+// runs those with -serialize-by dir, so directories don't cancel each other.
+func perDirThen(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+	for {
+		var next string
+		for dir, w := range pendingDirs {
+			if next == "" || w.due.Before(pendingDirs[next].due) {
+				next = dir
+			}
+		}
+		var quiet <-chan time.Time
+		if next != "" {
+			quiet = clk.After(pendingDirs[next].due.Sub(clk.Now()))
+		}
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			dir := filepath.Dir(event.Name)
+			w, ok := pendingDirs[dir]
+			if ok {
+				w.changed.add(event)
+			} else {
+				w = &dirWindow{changed: newChangeSet(event)}
+				pendingDirs[dir] = w
+			}
+			w.due = clk.Now().Add(eventInterval(event))
+			if *verbose {
+				log.Printf("event: %s, wait for next in %s", event, dir)
+			}
+		case <-quiet:
+			w := pendingDirs[next]
+			delete(pendingDirs, next)
+			cb(w.changed.events)
+			return
+		}
+	}
+}
+
+// drain returns the events already queued without waiting for more.
+func drain(events <-chan fsnotify.Event) []fsnotify.Event {
+	queued := make([]fsnotify.Event, 0)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return queued
+			}
+			queued = append(queued, event)
+		default:
+			return queued
+		}
+	}
+}
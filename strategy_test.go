@@ -0,0 +1,356 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const ms = time.Millisecond
+
+// fakeClock only moves when a test advances it. Every After call is reported
+// on asked, which tells the test the strategy is about to wait.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	asked  chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), asked: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), c: ch})
+	}
+	c.asked <- d
+	return ch
+}
+
+// Advance moves the clock on by d and fires the timers due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// step is one thing a strategy test does, see the functions below.
+type step struct {
+	send    string
+	queue   string
+	wait    time.Duration
+	advance time.Duration
+	run     []string
+	idle    bool
+}
+
+// send sends an event for name and waits for the strategy to take it.
+func send(name string) step { return step{send: name} }
+
+// queue sends an event for name without waiting for the strategy to take it.
+func queue(name string) step { return step{queue: name} }
+
+// waits expects the strategy to ask the clock for a timer of d.
+func waits(d time.Duration) step { return step{wait: d} }
+
+// advance moves the clock on by d.
+func advance(d time.Duration) step { return step{advance: d} }
+
+// runs expects the strategy to call back with events for names.
+func runs(names ...string) step { return step{run: names} }
+
+// idle expects no call back so far.
+func idle() step { return step{idle: true} }
+
+// testStrategy calls s over and over like the main loop does, with a fake
+// clock, and goes through steps.
+func testStrategy(t *testing.T, s strategy, steps []step) {
+	c := newFakeClock()
+	old := clk
+	clk = c
+
+	events := make(chan fsnotify.Event, 100)
+	called := make(chan []string, 100)
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	// The strategy has to be gone before the next test swaps the clock.
+	defer func() {
+		close(stopped)
+		close(events)
+		c.Advance(time.Hour)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("strategy still running")
+		}
+		clk = old
+	}()
+	go func() {
+		defer close(done)
+		for {
+			s(events, func(changed []fsnotify.Event) {
+				names := make([]string, len(changed))
+				for i, event := range changed {
+					names[i] = event.Name
+				}
+				called <- names
+			})
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+		}
+	}()
+
+	for i, st := range steps {
+		switch {
+		case st.send != "":
+			events <- fsnotify.Event{Name: st.send, Op: fsnotify.Write}
+			deadline := time.Now().Add(time.Second)
+			for len(events) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("step %d: event for %s not taken", i, st.send)
+				}
+				time.Sleep(ms)
+			}
+		case st.queue != "":
+			events <- fsnotify.Event{Name: st.queue, Op: fsnotify.Write}
+		case st.wait > 0:
+			select {
+			case d := <-c.asked:
+				if d != st.wait {
+					t.Fatalf("step %d: waits for %s, want %s", i, d, st.wait)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("step %d: doesn't wait for %s", i, st.wait)
+			}
+		case st.advance > 0:
+			c.Advance(st.advance)
+		case st.run != nil:
+			select {
+			case names := <-called:
+				if !reflect.DeepEqual(names, st.run) {
+					t.Fatalf("step %d: runs for %v, want %v", i, names, st.run)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("step %d: doesn't run for %v", i, st.run)
+			}
+		case st.idle:
+			select {
+			case names := <-called:
+				t.Fatalf("step %d: runs for %v, want no run yet", i, names)
+			default:
+			}
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	defer func(interval, wait time.Duration) {
+		debounceInterval.interval, *maxWait = interval, wait
+	}(debounceInterval.interval, *maxWait)
+	debounceInterval.interval = 100 * ms
+
+	scaled := func(events <-chan fsnotify.Event, cb func(changed []fsnotify.Event)) {
+		debounceScaled(events, cb, func(interval time.Duration, files int) time.Duration {
+			return interval * time.Duration(files)
+		})
+	}
+
+	tests := []struct {
+		name     string
+		maxWait  time.Duration
+		strategy strategy
+		steps    []step
+	}{
+		{
+			name:     "nothing runs on the leading edge",
+			strategy: debounceThen,
+			steps:    []step{send("a"), waits(100 * ms), idle(), advance(50 * ms), idle()},
+		},
+		{
+			name:     "runs on the trailing edge",
+			strategy: debounceThen,
+			steps:    []step{send("a"), waits(100 * ms), advance(99 * ms), idle(), advance(ms), runs("a")},
+		},
+		{
+			name:     "every event restarts the quiet period",
+			strategy: debounceThen,
+			steps: []step{
+				send("a"), waits(100 * ms), advance(60 * ms),
+				send("b"), waits(100 * ms), advance(60 * ms), idle(),
+				advance(40 * ms), runs("a", "b"),
+			},
+		},
+		{
+			name:     "runs again for the next change",
+			strategy: debounceThen,
+			steps: []step{
+				send("a"), waits(100 * ms), advance(100 * ms), runs("a"),
+				send("b"), waits(100 * ms), advance(100 * ms), runs("b"),
+			},
+		},
+		{
+			name:     "max-wait ends a storm",
+			maxWait:  250 * ms,
+			strategy: debounceThen,
+			steps: []step{
+				send("a"), waits(250 * ms), waits(100 * ms), advance(80 * ms),
+				send("b"), waits(100 * ms), advance(80 * ms),
+				send("c"), waits(100 * ms), advance(80 * ms),
+				send("d"), waits(100 * ms), advance(9 * ms), idle(),
+				advance(ms), runs("a", "b", "c", "d"),
+			},
+		},
+		{
+			name:     "max-wait starts over with the next change",
+			maxWait:  250 * ms,
+			strategy: debounceThen,
+			steps: []step{
+				send("a"), waits(250 * ms), waits(100 * ms), advance(100 * ms), runs("a"),
+				send("b"), waits(250 * ms), waits(100 * ms), advance(100 * ms), runs("b"),
+			},
+		},
+		{
+			name:     "scaled by the number of files",
+			strategy: scaled,
+			steps: []step{
+				send("a"), waits(100 * ms),
+				send("b"), waits(200 * ms),
+				send("a"), waits(200 * ms), advance(199 * ms), idle(),
+				advance(ms), runs("b", "a"),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*maxWait = test.maxWait
+			testStrategy(t, test.strategy, test.steps)
+		})
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	defer func(interval time.Duration) { debounceInterval.interval = interval }(debounceInterval.interval)
+	debounceInterval.interval = 100 * ms
+
+	tests := []struct {
+		name     string
+		strategy string
+		steps    []step
+	}{
+		{
+			name:     "debounce waits for quiet",
+			strategy: "debounce",
+			steps: []step{
+				send("a"), waits(100 * ms), advance(90 * ms),
+				send("b"), waits(100 * ms), advance(90 * ms), idle(),
+				advance(10 * ms), runs("a", "b"),
+			},
+		},
+		{
+			name:     "throttle runs right away",
+			strategy: "throttle",
+			steps:    []step{send("a"), waits(100 * ms), runs("a")},
+		},
+		{
+			name:     "throttle holds changes back for the interval",
+			strategy: "throttle",
+			steps: []step{
+				send("a"), waits(100 * ms), runs("a"),
+				queue("b"), queue("c"), advance(99 * ms), idle(),
+				advance(ms), waits(100 * ms), runs("b", "c"),
+			},
+		},
+		{
+			name:     "throttle runs at once again after a quiet interval",
+			strategy: "throttle",
+			steps: []step{
+				send("a"), waits(100 * ms), runs("a"), advance(500 * ms),
+				send("b"), waits(100 * ms), runs("b"),
+			},
+		},
+		{
+			name:     "batch runs an interval after the first change",
+			strategy: "batch",
+			steps: []step{
+				send("a"), waits(100 * ms), advance(50 * ms),
+				send("b"), advance(40 * ms),
+				send("c"), idle(), advance(10 * ms), runs("a", "b", "c"),
+			},
+		},
+		{
+			name:     "batch starts a new window with the next change",
+			strategy: "batch",
+			steps: []step{
+				send("a"), waits(100 * ms), advance(100 * ms), runs("a"),
+				send("b"), waits(100 * ms), advance(99 * ms), idle(),
+				advance(ms), runs("b"),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testStrategy(t, strategies[test.strategy], test.steps)
+		})
+	}
+}
+
+func TestChangeSet(t *testing.T) {
+	defer func(max int) { *maxChanges = max }(*maxChanges)
+	*maxChanges = 3
+
+	tests := []struct {
+		events []string
+		want   []string
+	}{
+		{[]string{"a", "a", "a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "b", "a"}, []string{"b", "a"}},
+		{[]string{"a", "b", "c", "d", "b"}, []string{"a", "c", "b"}},
+	}
+	for _, test := range tests {
+		c := newChangeSet(fsnotify.Event{Name: test.events[0], Op: fsnotify.Write})
+		for _, name := range test.events[1:] {
+			c.add(fsnotify.Event{Name: name, Op: fsnotify.Write})
+		}
+		names := make([]string, len(c.events))
+		for i, event := range c.events {
+			names[i] = event.Name
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%v collects %v, want %v", test.events, names, test.want)
+		}
+	}
+	droppedChanges = 0
+}
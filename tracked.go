@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var gitTracked = flags.Bool("git-tracked", false, "only run for files git tracks in -base, as listed by git ls-files, refreshed on SIGHUP")
+
+// tracked are the files git ls-files lists for -git-tracked. Only the
+// goroutine matching events uses it once watching has started.
+var tracked map[string]bool
+
+// loadTracked lists the files git tracks in baseDir.
+func loadTracked() error {
+	cmd := exec.Command("git", "ls-files", "-z")
+	cmd.Dir = baseDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("can't list git tracked files: %s %s %s", baseDir, err, strings.TrimSpace(stderr.String()))
+	}
+	files := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files[filepath.Join(baseDir, name)] = true
+		}
+	}
+	tracked = files
+	return nil
+}
+
+func isTracked(name string) bool {
+	return tracked[filepath.Clean(name)]
+}
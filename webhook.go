@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headerList collects every -webhook-header flag.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header must look like Name: value: %s", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+func (h *headerList) reset() {
+	*h = nil
+}
+
+var webhookHeaders headerList
+
+func init() {
+	flags.Var(&webhookHeaders, "webhook-header", "header to send with -webhook requests as Name: value, may be repeated")
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postWebhook sends a change to -webhook, retrying failed requests up to
+// -webhook-retries times with a delay doubling from a second.
+func postWebhook(t trigger) {
+	body, err := json.Marshal(socketRecord{Event: "change", Time: time.Now(), Files: t.files})
+	if err != nil {
+		log.Printf("can't encode change for webhook: %s", err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postOnce(body)
+		if err == nil {
+			return
+		}
+		if attempt >= *webhookRetries {
+			log.Printf("webhook failed, giving up: %s", err)
+			return
+		}
+		log.Printf("webhook failed, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postOnce(body []byte) error {
+	req, err := http.NewRequest("POST", *webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range webhookHeaders {
+		i := strings.Index(h, ":")
+		req.Header.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", *webhook, resp.Status)
+	}
+	return nil
+}